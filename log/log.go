@@ -7,6 +7,7 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"sync"
 
@@ -15,7 +16,41 @@ import (
 
 // SeeleLog wrapped log class
 type SeeleLog struct {
-	log *logrus.Logger
+	log logrus.FieldLogger
+}
+
+// Level is the severity of log entries, entries less severe than the level
+// of a logger are suppressed
+type Level = logrus.Level
+
+// Levels of log entries, from the most severe to the least
+const (
+	PanicLevel = logrus.PanicLevel
+	FatalLevel = logrus.FatalLevel
+	ErrorLevel = logrus.ErrorLevel
+	WarnLevel  = logrus.WarnLevel
+	InfoLevel  = logrus.InfoLevel
+	DebugLevel = logrus.DebugLevel
+)
+
+// Fields are the key/value pairs attached to log entries
+type Fields map[string]interface{}
+
+// NewLogger creates a logger writing entries of level or more severe to out
+func NewLogger(out io.Writer, level Level) *SeeleLog {
+	log := logrus.New()
+	log.Out = out
+	log.SetLevel(level)
+	return &SeeleLog{
+		log: log,
+	}
+}
+
+// WithFields returns a logger attaching fields to all entries
+func (p *SeeleLog) WithFields(fields Fields) *SeeleLog {
+	return &SeeleLog{
+		log: p.log.WithFields(logrus.Fields(fields)),
+	}
 }
 
 var log *logrus.Logger
@@ -6,6 +6,8 @@
 package log
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -17,3 +19,18 @@ func Test_Log(t *testing.T) {
 	//Fatal("fatal msg")
 	//panic("panic msg")
 }
+
+func Test_NewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf, InfoLevel).WithFields(Fields{"peer": "p1"})
+
+	log.Debug("debug msg")
+	if buf.Len() != 0 {
+		t.Fatalf("debug entry is not suppressed: %s", buf.String())
+	}
+
+	log.Info("info msg")
+	if out := buf.String(); !strings.Contains(out, "info msg") || !strings.Contains(out, "peer=p1") {
+		t.Fatalf("unexpected entry: %s", out)
+	}
+}
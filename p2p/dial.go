@@ -0,0 +1,224 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+const (
+	// Minimum time before a node is dialed again.
+	dialHistoryExpiry = 30 * time.Second
+
+	// Minimum time before a node disconnected for protocol error or flood is dialed again.
+	protocolErrorBackoff = 10 * time.Minute
+
+	// Default maximum random delay added to dial scheduling.
+	defaultDialJitter = 3 * time.Second
+
+	// Weight of the latest session in the quality score of a node.
+	qualityDecay = 0.3
+
+	// Minimum selection weight of a node, so that a node of low score can be selected.
+	minQualityWeight = 1.0
+)
+
+// Dialer creates outbound connections, e.g. through a SOCKS5 proxy.
+// net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialHistory records when nodes can be dialed again, so a node is not redialed
+// on every schedule.
+type dialHistory struct {
+	lock sync.Mutex
+	next map[common.Address]time.Time
+}
+
+func newDialHistory() *dialHistory {
+	return &dialHistory{
+		next: make(map[common.Address]time.Time),
+	}
+}
+
+// add records a dial of id at now if it is allowed, the node can be dialed again
+// after expiry. It returns false if the node was dialed recently.
+func (h *dialHistory) add(id common.Address, now time.Time, expiry time.Duration) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if next, ok := h.next[id]; ok && now.Before(next) {
+		return false
+	}
+	h.next[id] = now.Add(expiry)
+	return true
+}
+
+// ready returns whether id can be dialed at now
+func (h *dialHistory) ready(id common.Address, now time.Time) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	next, ok := h.next[id]
+	return !ok || !now.Before(next)
+}
+
+// backoff delays the next dial of id until the given time, unless it is later already
+func (h *dialHistory) backoff(id common.Address, until time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if next, ok := h.next[id]; !ok || next.Before(until) {
+		h.next[id] = until
+	}
+}
+
+// forget makes id ready to be dialed at once
+func (h *dialHistory) forget(id common.Address) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.next, id)
+}
+
+// reconnectPolicy records the last disconnect reason of nodes, and schedules their
+// redial by it. Nodes quit for benign reasons can be redialed at once, nodes quit for
+// protocol errors are backed off, and hostile nodes are not redialed until restart.
+type reconnectPolicy struct {
+	lock    sync.Mutex
+	reasons map[common.Address]uint // node ID => last disconnect reason
+	history *dialHistory
+}
+
+func newReconnectPolicy(history *dialHistory) *reconnectPolicy {
+	return &reconnectPolicy{
+		reasons: make(map[common.Address]uint),
+		history: history,
+	}
+}
+
+// record applies the disconnect reason of id to the dial history at now
+func (r *reconnectPolicy) record(id common.Address, reason uint, now time.Time) {
+	r.lock.Lock()
+	r.reasons[id] = reason
+	r.lock.Unlock()
+
+	switch {
+	case benignReason(reason):
+		r.history.forget(id)
+	case reason == discProtocolError || reason == discMsgFlood:
+		r.history.backoff(id, now.Add(protocolErrorBackoff))
+	}
+}
+
+// allowed returns false if id is not redialed until restart
+func (r *reconnectPolicy) allowed(id common.Address) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	reason, ok := r.reasons[id]
+	return !ok || !hostileReason(reason)
+}
+
+// benignReason reports whether nodes disconnected for reason can be redialed at once
+func benignReason(reason uint) bool {
+	return reason == discServerQuit || reason == discTooManyPeers || reason == discBusy
+}
+
+// hostileReason reports whether nodes disconnected for reason are avoided until restart,
+// such as nodes rejected at handshake or impersonating another node.
+func hostileReason(reason uint) bool {
+	return reason == discHandshakeReject || reason == discNetworkMismatch || reason == discImpersonation
+}
+
+// jitter returns a random duration in [0, max), so that nodes coming back from
+// a network blip don't dial each other in synchronized waves.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// nodeQuality keeps the quality scores of nodes across connections, a higher
+// score is better. The score is the moving average of session durations in seconds.
+type nodeQuality struct {
+	lock   sync.Mutex
+	scores map[common.Address]float64
+}
+
+func newNodeQuality() *nodeQuality {
+	return &nodeQuality{
+		scores: make(map[common.Address]float64),
+	}
+}
+
+// observe updates the score of id by a quit session of it
+func (q *nodeQuality) observe(id common.Address, session time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	s := session.Seconds()
+	if old, ok := q.scores[id]; ok {
+		s = (1-qualityDecay)*old + qualityDecay*s
+	}
+	q.scores[id] = s
+}
+
+// selectNodes draws up to n nodes at random without replacement, weighted by their
+// quality scores. Unknown nodes weigh the average of known ones, so nodes are drawn
+// uniformly if none is known.
+func (q *nodeQuality) selectNodes(nodes []*discovery.Node, n int) []*discovery.Node {
+	weights := make([]float64, len(nodes))
+	known, sum := 0, 0.0
+	q.lock.Lock()
+	for i, node := range nodes {
+		if s, ok := q.scores[node.ID]; ok {
+			weights[i] = math.Max(s, minQualityWeight)
+			known++
+			sum += weights[i]
+		}
+	}
+	q.lock.Unlock()
+
+	unknown := minQualityWeight
+	if known > 0 {
+		unknown = sum / float64(known)
+	}
+	total := 0.0
+	for i := range weights {
+		// known weights are positive
+		if weights[i] == 0 {
+			weights[i] = unknown
+		}
+		total += weights[i]
+	}
+
+	candidates := append([]*discovery.Node(nil), nodes...)
+	var selected []*discovery.Node
+	for len(selected) < n && len(candidates) > 0 {
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(candidates)-1 && r >= weights[i]; i++ {
+			r -= weights[i]
+		}
+		selected = append(selected, candidates[i])
+		total -= weights[i]
+		last := len(candidates) - 1
+		candidates[i], weights[i] = candidates[last], weights[last]
+		candidates, weights = candidates[:last], weights[:last]
+	}
+	return selected
+}
@@ -0,0 +1,122 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+func Test_DialHistory(t *testing.T) {
+	h := newDialHistory()
+	var id common.Address
+	now := time.Now()
+
+	assert.Equal(t, h.add(id, now, time.Second), true)
+	assert.Equal(t, h.add(id, now.Add(500*time.Millisecond), time.Second), false)
+	assert.Equal(t, h.add(id, now.Add(time.Second), time.Second), true)
+}
+
+func Test_Jitter(t *testing.T) {
+	assert.Equal(t, jitter(0), time.Duration(0))
+	assert.Equal(t, jitter(-time.Second), time.Duration(0))
+
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		if d < 0 || d >= time.Second {
+			t.Fatalf("jitter %s out of range", d)
+		}
+	}
+}
+
+func Test_DialHistory_Backoff(t *testing.T) {
+	h := newDialHistory()
+	var id common.Address
+	now := time.Now()
+
+	h.backoff(id, now.Add(time.Minute))
+	assert.Equal(t, h.add(id, now.Add(30*time.Second), time.Second), false)
+
+	// an earlier backoff does not shorten it
+	h.backoff(id, now)
+	assert.Equal(t, h.add(id, now.Add(30*time.Second), time.Second), false)
+	assert.Equal(t, h.add(id, now.Add(time.Minute), time.Second), true)
+}
+
+func Test_NodeQuality_SelectNodes(t *testing.T) {
+	q := newNodeQuality()
+	good := &discovery.Node{ID: common.Address{1}}
+	bad := &discovery.Node{ID: common.Address{2}}
+	unknown := &discovery.Node{ID: common.Address{3}}
+	q.observe(good.ID, time.Hour)
+	q.observe(bad.ID, time.Second)
+	nodes := []*discovery.Node{good, bad, unknown}
+
+	counts := make(map[common.Address]int)
+	for i := 0; i < 1000; i++ {
+		selected := q.selectNodes(nodes, 1)
+		assert.Equal(t, len(selected), 1)
+		counts[selected[0].ID]++
+	}
+	if counts[good.ID] <= counts[bad.ID] {
+		t.Fatalf("good node is not preferred, %v", counts)
+	}
+	// unknown nodes weigh the average of known ones
+	if counts[unknown.ID] <= counts[bad.ID] {
+		t.Fatalf("unknown node is not preferred to bad one, %v", counts)
+	}
+
+	// all nodes are selected without replacement
+	selected := q.selectNodes(nodes, 5)
+	assert.Equal(t, len(selected), 3)
+	seen := make(map[common.Address]bool)
+	for _, node := range selected {
+		seen[node.ID] = true
+	}
+	assert.Equal(t, len(seen), 3)
+}
+
+func Test_NodeQuality_Observe(t *testing.T) {
+	q := newNodeQuality()
+	var id common.Address
+	q.observe(id, 10*time.Second)
+	assert.Equal(t, q.scores[id], 10.0)
+	q.observe(id, 20*time.Second)
+	assert.Equal(t, q.scores[id], 13.0)
+}
+
+func Test_ReconnectPolicy(t *testing.T) {
+	h := newDialHistory()
+	r := newReconnectPolicy(h)
+	benign, faulty, hostile, unknown := common.Address{1}, common.Address{2}, common.Address{3}, common.Address{4}
+	now := time.Now()
+	for _, id := range []common.Address{benign, faulty, hostile, unknown} {
+		h.add(id, now, dialHistoryExpiry)
+	}
+
+	r.record(benign, discTooManyPeers, now)
+	r.record(faulty, discProtocolError, now)
+	r.record(hostile, discNetworkMismatch, now)
+
+	// benign reasons can be redialed at once
+	assert.Equal(t, h.ready(benign, now), true)
+	assert.Equal(t, r.allowed(benign), true)
+
+	// others wait for the dial history expiry, protocol errors longer
+	assert.Equal(t, h.ready(unknown, now), false)
+	assert.Equal(t, h.ready(unknown, now.Add(dialHistoryExpiry)), true)
+	assert.Equal(t, h.ready(faulty, now.Add(dialHistoryExpiry)), false)
+	assert.Equal(t, h.ready(faulty, now.Add(protocolErrorBackoff)), true)
+	assert.Equal(t, r.allowed(faulty), true)
+
+	// hostile nodes are never redialed
+	assert.Equal(t, r.allowed(hostile), false)
+	assert.Equal(t, r.allowed(unknown), true)
+}
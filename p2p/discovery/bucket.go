@@ -31,15 +31,15 @@ func newBuckets() *bucket {
 
 // addNode add node to bucket, if bucket is full, will remove an old one
 func (b *bucket) addNode(node *Node) {
-	index := b.hasNode(node)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	index := b.indexOf(node)
 
 	if index != -1 {
 		// do nothing for now
 		// TODO lru
 	} else {
-		b.lock.Lock()
-		defer b.lock.Unlock()
-
 		log.Info("add node: %s", hexutil.BytesToHex(node.ID.Bytes()))
 		if len(b.peers) < bucketSize {
 			b.peers = append(b.peers, node)
@@ -54,6 +54,12 @@ func (b *bucket) addNode(node *Node) {
 func (b *bucket) hasNode(node *Node) int {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+
+	return b.indexOf(node)
+}
+
+// indexOf returns the index of node in the bucket or -1, the caller holds the lock
+func (b *bucket) indexOf(node *Node) int {
 	for index, n := range b.peers {
 		if n.ID == node.ID {
 			return index
@@ -86,6 +92,15 @@ func (b *bucket) deleteNode(target *common.Hash) {
 	b.peers = append(b.peers[:index], b.peers[index+1:]...)
 }
 
+// nodes returns a copy of the nodes in the bucket, which is safe to iterate
+// while the bucket changes
+func (b *bucket) nodes() []*Node {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]*Node(nil), b.peers...)
+}
+
 func (b *bucket) size() int {
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -6,6 +6,7 @@
 package discovery
 
 import (
+	"encoding/binary"
 	"net"
 
 	"github.com/seeleteam/go-seele/common"
@@ -23,12 +24,19 @@ const (
 
 const (
 	discoveryProtocolVersion uint = 1
+
+	// packet header: msg type(1) network ID(4)
+	packetHeaderSize = 5
 )
 
 type ping struct {
 	Version uint // TODO add version check
 	SelfID  common.Address
 
+	// advertised ports of the sender
+	UDPPort uint16
+	TCPPort uint16
+
 	to *Node
 }
 
@@ -52,10 +60,13 @@ type rpcNode struct {
 	SelfID  common.Address
 	IP      net.IP
 	UDPPort uint16
+	TCPPort uint16
 }
 
 func (r *rpcNode) ToNode() *Node {
-	return NewNode(r.SelfID, r.IP, int(r.UDPPort))
+	n := NewNode(r.SelfID, r.IP, int(r.UDPPort))
+	n.TCPPort = int(r.TCPPort)
+	return n
 }
 
 func byteToMsgType(byte byte) msgType {
@@ -66,8 +77,10 @@ func msgTypeToByte(t msgType) byte {
 	return byte(t)
 }
 
-func generateBuff(code msgType, encoding []byte) []byte {
-	buff := []byte{msgTypeToByte(code)}
+func generateBuff(code msgType, networkID uint32, encoding []byte) []byte {
+	buff := make([]byte, packetHeaderSize, packetHeaderSize+len(encoding))
+	buff[0] = msgTypeToByte(code)
+	binary.BigEndian.PutUint32(buff[1:packetHeaderSize], networkID)
 
 	return append(buff, encoding...)
 }
@@ -81,6 +94,14 @@ func (m *ping) handle(t *udp, from *net.UDPAddr) {
 		return
 	}
 
+	// ping announces the sender with its advertised ports
+	node := NewNodeWithAddr(m.SelfID, from)
+	if m.UDPPort != 0 {
+		node.UDPPort = int(m.UDPPort)
+	}
+	node.TCPPort = int(m.TCPPort)
+	t.addNode(node)
+
 	resp := &pong{
 		SelfID: t.self.ID,
 	}
@@ -111,15 +132,18 @@ func (m *ping) send(t *udp) {
 		},
 	}
 
-	t.addPending <- p
+	t.addPendingReq(p)
 	t.sendMsg(pingMsgType, m, m.to)
 }
 
 // handle response find node request
 func (m *findNode) handle(t *udp, from *net.UDPAddr) {
 	//log.Debug("received find node request from: %s", hexutil.BytesToHex(m.SelfID.Bytes()))
+	// the request carries no advertised ports, a known node keeps the ones of its ping
 	node := NewNodeWithAddr(m.SelfID, from)
-	t.addNode(node)
+	if t.db.find(*node.getSha()) == nil {
+		t.addNode(node)
+	}
 
 	nodes := t.table.findNodeWithTarget(m.QueryID.ToSha(), t.self.getSha())
 
@@ -129,6 +153,7 @@ func (m *findNode) handle(t *udp, from *net.UDPAddr) {
 			SelfID:  n.ID,
 			IP:      n.IP,
 			UDPPort: uint16(n.UDPPort),
+			TCPPort: uint16(n.TCPPort),
 		}
 	}
 
@@ -183,7 +208,7 @@ func (m *findNode) send(t *udp) {
 		},
 	}
 
-	t.addPending <- p
+	t.addPendingReq(p)
 	t.sendMsg(findNodeMsgType, m, m.to)
 }
 
@@ -14,7 +14,7 @@ import (
 func getUDPConn(addr *net.UDPAddr) *net.UDPConn {
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		log.Info(err.Error())
+		log.Info("%s", err.Error())
 	}
 
 	return conn
@@ -24,7 +24,7 @@ func getAddr(port string) *net.UDPAddr {
 	address := ":" + port
 	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
-		log.Error(err.Error())
+		log.Error("%s", err.Error())
 	}
 
 	return addr
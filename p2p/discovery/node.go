@@ -42,6 +42,7 @@ func NewNode(id common.Address, ip net.IP, port int) *Node {
 		ID:      id,
 		IP:      ip,
 		UDPPort: port,
+		sha:     id.ToSha(),
 	}
 }
 
@@ -89,9 +90,12 @@ func (n *Node) GetUDPAddr() *net.UDPAddr {
 	}
 }
 
+// getSha returns the sha computed by NewNode. Nodes are shared by the loops of
+// discovery, so the sha of a node not created by NewNode is computed per call
+// instead of being cached without lock.
 func (n *Node) getSha() *common.Hash {
 	if n.sha == nil || len(n.sha) == 0 {
-		n.sha = n.ID.ToSha()
+		return n.ID.ToSha()
 	}
 
 	return n.sha
@@ -13,21 +13,66 @@ import (
 	"github.com/seeleteam/go-seele/common"
 )
 
-// StartServerFat used by p2p.Server to start discovery service
-func StartServerFat(port string, id string, nodeArr []*Node) (db *Database) {
+// Service is a running discovery service started by StartServerFat
+type Service struct {
+	udp *udp
+}
+
+// StartServerFat used by p2p.Server to start discovery service of the network
+// networkID, it returns an error if the udp port can not be listened.
+func StartServerFat(port string, id string, networkID uint32, nodeArr []*Node) (*Service, error) {
 	myId := common.HexToAddress(id)
-	addr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("0.0.0.0:%s", port))
-	udp := newUDP(myId, addr)
+	addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("0.0.0.0:%s", port))
+	if err != nil {
+		return nil, err
+	}
+	udp := newUDP(myId, addr, networkID)
+	if udp.conn == nil {
+		return nil, fmt.Errorf("failed to listen on udp port %s", port)
+	}
 	for _, node := range nodeArr {
 		udp.addNode(node)
 	}
 
 	udp.StartServe()
-	return udp.db
+	return &Service{udp: udp}, nil
+}
+
+// Database returns the database of known nodes
+func (s *Service) Database() *Database {
+	return s.udp.db
+}
+
+// AdvertisedPorts returns the TCP and UDP ports announced to other nodes
+func (s *Service) AdvertisedPorts() (tcpPort, udpPort int) {
+	return s.udp.advertisedPorts()
+}
+
+// Bootstrap seeds discovery with nodes, which are not added to the database.
+// Nodes are asked for the neighbors of self and learn self by ping.
+func (s *Service) Bootstrap(nodes []*Node) {
+	for _, node := range nodes {
+		if node.ID == s.udp.self.ID {
+			continue
+		}
+		s.udp.newPing(node).send(s.udp)
+		sendFindNodeRequest(s.udp, []*Node{node}, s.udp.self.ID)
+	}
+}
+
+// Stop closes the udp conn of the service and waits for its goroutines to quit
+func (s *Service) Stop() {
+	s.udp.close()
+}
+
+// SetAdvertisedPorts changes the TCP and UDP ports announced to other nodes,
+// e.g. after NAT mapping changes, and re-announces them to all known nodes.
+func (s *Service) SetAdvertisedPorts(tcpPort, udpPort int) {
+	s.udp.setAdvertisedPorts(tcpPort, udpPort)
 }
 
 func StartService(myId common.Address, myAddr *net.UDPAddr, bootstrap *Node) {
-	udp := newUDP(myId, myAddr)
+	udp := newUDP(myId, myAddr, 0)
 
 	if bootstrap != nil {
 		udp.addNode(bootstrap)
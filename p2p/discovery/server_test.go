@@ -0,0 +1,103 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/common/hexutil"
+)
+
+func startTestService(t *testing.T, nodes ...*Node) (*Service, common.Address) {
+	return startTestNetworkService(t, 0, nodes...)
+}
+
+func startTestNetworkService(t *testing.T, networkID uint32, nodes ...*Node) (*Service, common.Address) {
+	id, err := common.GenerateRandomAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := StartServerFat("0", hexutil.BytesToHex(id.Bytes()), networkID, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, *id
+}
+
+func Test_Service_SetAdvertisedPorts(t *testing.T) {
+	s1, id1 := startTestService(t)
+	_, udpPort1 := s1.AdvertisedPorts()
+	node1 := NewNode(id1, net.ParseIP("127.0.0.1"), udpPort1)
+
+	s2, id2 := startTestService(t, node1)
+	_, udpPort2 := s2.AdvertisedPorts()
+	s2.SetAdvertisedPorts(4000, udpPort2)
+
+	tcpPort, udpPort := s2.AdvertisedPorts()
+	assert.Equal(t, udpPort, udpPort2)
+	assert.Equal(t, tcpPort, 4000)
+
+	// s1 should learn the new ports from the announcement
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range s1.Database().GetCopy() {
+			if n.ID == id2 && n.TCPPort == 4000 {
+				assert.Equal(t, n.UDPPort, udpPort2)
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("advertised ports are not announced")
+}
+
+func Test_Service_NetworkID(t *testing.T) {
+	s1, id1 := startTestNetworkService(t, 1)
+	_, udpPort1 := s1.AdvertisedPorts()
+	node1 := NewNode(id1, net.ParseIP("127.0.0.1"), udpPort1)
+
+	// s2 is of the same network as s1, s3 is of another one
+	s2, id2 := startTestNetworkService(t, 1)
+	s3, id3 := startTestNetworkService(t, 2)
+	s3.Bootstrap([]*Node{node1})
+	s2.Bootstrap([]*Node{node1})
+
+	known := func(s *Service, id common.Address) bool {
+		for _, n := range s.Database().GetCopy() {
+			if n.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !known(s1, id2) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, known(s1, id2), true)
+	// packets of the other network are dropped, s3 pinged s1 before s2
+	assert.Equal(t, known(s1, id3), false)
+	assert.Equal(t, known(s3, id1), false)
+}
+
+func Test_Service_Stop(t *testing.T) {
+	s, _ := startTestService(t)
+	_, udpPort := s.AdvertisedPorts()
+	s.Stop()
+
+	// the udp port is free after Stop
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: udpPort})
+	assert.Equal(t, err, nil)
+	conn.Close()
+
+	// Stop again is safe
+	s.Stop()
+}
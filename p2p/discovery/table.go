@@ -86,7 +86,7 @@ func (t *Table) findMinDisNodes(target *common.Hash, number int) []*Node {
 	}
 
 	for _, b := range t.buckets {
-		for _, n := range b.peers {
+		for _, n := range b.nodes() {
 			result.push(n)
 		}
 	}
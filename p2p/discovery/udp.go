@@ -7,7 +7,9 @@ package discovery
 
 import (
 	"container/list"
+	"encoding/binary"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/seeleteam/go-seele/common"
@@ -29,11 +31,18 @@ type udp struct {
 
 	db        *Database
 	localAddr *net.UDPAddr
+	networkID uint32 // packets of other networks are dropped
 
 	gotReply   chan *reply
 	addPending chan *pending
 	writer     chan *send
 	log        *log.SeeleLog
+
+	portLock sync.Mutex // protects the advertised ports of self
+
+	quit      chan struct{} // closed to stop all goroutines
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 type pending struct {
@@ -62,12 +71,19 @@ type reply struct {
 	data interface{}
 }
 
-func newUDP(id common.Address, addr *net.UDPAddr) *udp {
+func newUDP(id common.Address, addr *net.UDPAddr, networkID uint32) *udp {
+	conn := getUDPConn(addr)
+	if conn != nil {
+		// resolve the actual port if port 0 is used
+		addr = &net.UDPAddr{IP: addr.IP, Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	}
+
 	transport := &udp{
-		conn:      getUDPConn(addr),
+		conn:      conn,
 		table:     newTable(id, addr),
 		self:      NewNodeWithAddr(id, addr),
 		localAddr: addr,
+		networkID: networkID,
 
 		db: NewDatabase(),
 
@@ -75,6 +91,7 @@ func newUDP(id common.Address, addr *net.UDPAddr) *udp {
 		addPending: make(chan *pending, 1),
 		writer:     make(chan *send, 1),
 		log:        log.GetLogger("discovery", true),
+		quit:       make(chan struct{}),
 	}
 
 	return transport
@@ -83,17 +100,46 @@ func newUDP(id common.Address, addr *net.UDPAddr) *udp {
 func (u *udp) sendMsg(t msgType, msg interface{}, to *Node) {
 	encoding, err := common.Serialize(msg)
 	if err != nil {
-		log.Info(err.Error())
+		log.Info("%s", err.Error())
 		return
 	}
 
-	buff := generateBuff(t, encoding)
+	buff := generateBuff(t, u.networkID, encoding)
 	s := &send{
 		buff: buff,
 		to:   to,
 		code: t,
 	}
-	u.writer <- s
+	select {
+	case u.writer <- s:
+	case <-u.quit:
+	}
+}
+
+// addPendingReq waits for the response of a request, it returns if the udp is closed
+func (u *udp) addPendingReq(p *pending) {
+	select {
+	case u.addPending <- p:
+	case <-u.quit:
+	}
+}
+
+// reply passes r to loopReply, it returns if the udp is closed
+func (u *udp) reply(r *reply) {
+	select {
+	case u.gotReply <- r:
+	case <-u.quit:
+	}
+}
+
+// sleep waits for d, it returns false if the udp is closed meanwhile
+func (u *udp) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-u.quit:
+		return false
+	}
 }
 
 func sendMsg(buff []byte, conn *net.UDPConn, to *net.UDPAddr) bool {
@@ -113,8 +159,11 @@ func sendMsg(buff []byte, conn *net.UDPConn, to *net.UDPAddr) bool {
 }
 
 func (u *udp) sendLoop() {
+	defer u.wg.Done()
 	for {
 		select {
+		case <-u.quit:
+			return
 		case s := <-u.writer:
 			//log.Debug("send msg to: %d", s.to.Port)
 			success := sendMsg(s.buff, u.conn, s.to.GetUDPAddr())
@@ -125,23 +174,28 @@ func (u *udp) sendLoop() {
 					err:  true,
 				}
 
-				u.gotReply <- r
+				u.reply(r)
 			}
 		}
 	}
 }
 
 func (u *udp) handleMsg(from *net.UDPAddr, data []byte) {
-	if len(data) > 0 {
+	if len(data) >= packetHeaderSize {
 		code := byteToMsgType(data[0])
+		if networkID := binary.BigEndian.Uint32(data[1:packetHeaderSize]); networkID != u.networkID {
+			log.Debug("drop msg of network %d from %s", networkID, from)
+			return
+		}
+		payload := data[packetHeaderSize:]
 
 		//log.Debug("msg type: %d", code)
 		switch code {
 		case pingMsgType:
 			msg := &ping{}
-			err := common.Deserialize(data[1:], &msg)
+			err := common.Deserialize(payload, &msg)
 			if err != nil {
-				log.Info(err.Error())
+				log.Info("%s", err.Error())
 				return
 			}
 
@@ -149,9 +203,9 @@ func (u *udp) handleMsg(from *net.UDPAddr, data []byte) {
 			msg.handle(u, from)
 		case pongMsgType:
 			msg := &pong{}
-			err := common.Deserialize(data[1:], &msg)
+			err := common.Deserialize(payload, &msg)
 			if err != nil {
-				log.Info(err.Error())
+				log.Info("%s", err.Error())
 				return
 			}
 
@@ -162,13 +216,13 @@ func (u *udp) handleMsg(from *net.UDPAddr, data []byte) {
 				err:  false,
 			}
 
-			u.gotReply <- r
+			u.reply(r)
 		case findNodeMsgType:
 			msg := &findNode{}
 
-			err := common.Deserialize(data[1:], &msg)
+			err := common.Deserialize(payload, &msg)
 			if err != nil {
-				log.Info(err.Error())
+				log.Info("%s", err.Error())
 				return
 			}
 
@@ -176,9 +230,9 @@ func (u *udp) handleMsg(from *net.UDPAddr, data []byte) {
 			msg.handle(u, from)
 		case neighborsMsgType:
 			msg := &neighbors{}
-			err := common.Deserialize(data[1:], &msg)
+			err := common.Deserialize(payload, &msg)
 			if err != nil {
-				log.Info(err.Error())
+				log.Info("%s", err.Error())
 				return
 			}
 
@@ -189,7 +243,7 @@ func (u *udp) handleMsg(from *net.UDPAddr, data []byte) {
 				err:  false,
 			}
 
-			u.gotReply <- r
+			u.reply(r)
 		default:
 			log.Error("unknown code %d", code)
 		}
@@ -199,11 +253,18 @@ func (u *udp) handleMsg(from *net.UDPAddr, data []byte) {
 }
 
 func (u *udp) readLoop() {
+	defer u.wg.Done()
 	for {
 		data := make([]byte, 1024)
 		n, remoteAddr, err := u.conn.ReadFromUDP(data)
 		if err != nil {
-			log.Info(err.Error())
+			select {
+			case <-u.quit:
+				return
+			default:
+			}
+			log.Info("%s", err.Error())
+			continue
 		}
 
 		//log.Info("get msg from: %d", remoteAddr.Port)
@@ -214,6 +275,7 @@ func (u *udp) readLoop() {
 }
 
 func (u *udp) loopReply() {
+	defer u.wg.Done()
 	pendingList := list.New()
 
 	var timeout = time.NewTimer(0)
@@ -246,6 +308,8 @@ func (u *udp) loopReply() {
 		resetTimer()
 
 		select {
+		case <-u.quit:
+			return
 		case r := <-u.gotReply:
 			for el := pendingList.Front(); el != nil; el = el.Next() {
 				p := el.Value.(*pending)
@@ -282,10 +346,11 @@ func (u *udp) loopReply() {
 }
 
 func (u *udp) discovery() {
+	defer u.wg.Done()
 	for {
 		id, err := common.GenerateRandomAddress()
 		if err != nil {
-			log.Error(err.Error())
+			log.Error("%s", err.Error())
 			continue
 		}
 
@@ -294,29 +359,66 @@ func (u *udp) discovery() {
 		//log.Debug("query id: %s", hexutil.BytesToHex(id.Bytes()))
 		sendFindNodeRequest(u, nodes, *id)
 
-		time.Sleep(discoveryInterval)
+		if !u.sleep(discoveryInterval) {
+			return
+		}
 	}
 }
 
 func (u *udp) pingPongService() {
+	defer u.wg.Done()
 	for {
 		copyMap := u.db.GetCopy()
+		if len(copyMap) == 0 {
+			if !u.sleep(pingpongInterval) {
+				return
+			}
+			continue
+		}
 
 		for _, value := range copyMap {
-			p := &ping{
-				Version: discoveryProtocolVersion,
-				SelfID:  u.self.ID,
-
-				to: value,
+			u.newPing(value).send(u)
+			if !u.sleep(pingpongInterval) {
+				return
 			}
-
-			p.send(u)
-			time.Sleep(pingpongInterval)
 		}
 	}
 }
 
+func (u *udp) newPing(to *Node) *ping {
+	tcpPort, udpPort := u.advertisedPorts()
+	return &ping{
+		Version: discoveryProtocolVersion,
+		SelfID:  u.self.ID,
+		UDPPort: uint16(udpPort),
+		TCPPort: uint16(tcpPort),
+
+		to: to,
+	}
+}
+
+// advertisedPorts returns the ports announced to other nodes
+func (u *udp) advertisedPorts() (tcpPort, udpPort int) {
+	u.portLock.Lock()
+	defer u.portLock.Unlock()
+
+	return u.self.TCPPort, u.self.UDPPort
+}
+
+// setAdvertisedPorts changes the announced ports and re-announces self
+// to all known nodes at once, instead of waiting for the ping pong service.
+func (u *udp) setAdvertisedPorts(tcpPort, udpPort int) {
+	u.portLock.Lock()
+	u.self.TCPPort, u.self.UDPPort = tcpPort, udpPort
+	u.portLock.Unlock()
+
+	for _, value := range u.db.GetCopy() {
+		u.newPing(value).send(u)
+	}
+}
+
 func (u *udp) StartServe() {
+	u.wg.Add(5)
 	go u.readLoop()
 	go u.loopReply()
 	go u.discovery()
@@ -324,6 +426,15 @@ func (u *udp) StartServe() {
 	go u.sendLoop()
 }
 
+// close closes the udp conn and waits for all goroutines to quit
+func (u *udp) close() {
+	u.closeOnce.Do(func() {
+		close(u.quit)
+		u.conn.Close()
+	})
+	u.wg.Wait()
+}
+
 func (u *udp) addNode(n *Node) {
 	if n == nil || n.ID == u.self.ID {
 		return
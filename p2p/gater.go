@@ -0,0 +1,32 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"errors"
+	"net"
+
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+var errConnGated = errors.New("connection denied by gater")
+
+// ConnectionGater decides whether connections are allowed at each stage of their
+// lifecycle, such as to implement blacklists and allowlists. Methods are called
+// concurrently, and return false to deny the connection.
+type ConnectionGater interface {
+	// InterceptDial is called before an outbound dial to node.
+	InterceptDial(node *discovery.Node) bool
+
+	// InterceptAccept is called with the remote address of an inbound connection
+	// before handshake. Denied connections are closed at once.
+	InterceptAccept(addr net.Addr) bool
+
+	// InterceptSecured is called after handshake with the node ID of the remote.
+	// Denied peers are disconnected with discHandshakeReject.
+	InterceptSecured(inbound bool, nodeID common.Address, addr net.Addr) bool
+}
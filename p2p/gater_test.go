@@ -0,0 +1,133 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+// testGater denies the connections its funcs return false for, nil funcs allow all
+type testGater struct {
+	dial    func(node *discovery.Node) bool
+	accept  func(addr net.Addr) bool
+	secured func(inbound bool, nodeID common.Address) bool
+}
+
+func (g *testGater) InterceptDial(node *discovery.Node) bool {
+	return g.dial == nil || g.dial(node)
+}
+
+func (g *testGater) InterceptAccept(addr net.Addr) bool {
+	return g.accept == nil || g.accept(addr)
+}
+
+func (g *testGater) InterceptSecured(inbound bool, nodeID common.Address, addr net.Addr) bool {
+	return g.secured == nil || g.secured(inbound, nodeID)
+}
+
+func Test_Gater_InterceptDial(t *testing.T) {
+	srv := newTestServer(t)
+	allowed, denied := newTestNode(t), newTestNode(t)
+	denied.UDPPort = 2
+	bootAllowed, bootDenied := newTestNode(t), newTestNode(t)
+	bootAllowed.UDPPort, bootDenied.UDPPort = 3, 4
+	srv.StaticNodes = []*discovery.Node{allowed, denied}
+	srv.BootstrapNodes = []*discovery.Node{bootAllowed, bootDenied}
+	srv.DialJitter = -1
+	dialer := &testDialer{addrs: make(chan string, 16)}
+	srv.Dialer = dialer
+	srv.ConnectionGater = &testGater{
+		dial: func(node *discovery.Node) bool { return node.ID != denied.ID && node.ID != bootDenied.ID },
+	}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	dialed := make(map[string]bool)
+	timeout := time.After(3 * time.Second)
+	for len(dialed) < 2 {
+		select {
+		case addr := <-dialer.addrs:
+			dialed[addr] = true
+		case <-timeout:
+			t.Fatalf("allowed nodes are not dialed, %v", dialed)
+		}
+	}
+	select {
+	case addr := <-dialer.addrs:
+		dialed[addr] = true
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(t, dialed, map[string]bool{"tcp/127.0.0.1:1": true, "tcp/127.0.0.1:3": true})
+}
+
+func Test_Gater_InterceptAccept(t *testing.T) {
+	srv := newTestServer(t)
+	accepted := make(chan net.Addr, 1)
+	srv.ConnectionGater = &testGater{
+		accept: func(addr net.Addr) bool {
+			accepted <- addr
+			return false
+		},
+	}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	select {
+	case addr := <-accepted:
+		assert.Equal(t, addr.String(), conn.LocalAddr().String())
+	case <-time.After(time.Second):
+		t.Fatal("gater is not called on accept")
+	}
+
+	// closed without handshake
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, err, io.EOF)
+}
+
+func Test_Gater_InterceptSecured(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	secured := make(chan bool, 1)
+	srv.ConnectionGater = &testGater{
+		secured: func(inbound bool, nodeID common.Address) bool {
+			secured <- inbound
+			return nodeID != node.ID
+		},
+	}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	p := testHandshakeOnly(t, conn, node.ID, []Cap{proto.cap()})
+	assert.Equal(t, <-secured, true)
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(discHandshakeReject))
+
+	select {
+	case <-proto.added:
+		t.Fatal("denied peer is added")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
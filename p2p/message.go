@@ -6,16 +6,44 @@
 package p2p
 
 import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
 	"time"
 
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/seeleteam/go-seele/common"
 	"github.com/seeleteam/go-seele/p2p/discovery"
 )
 
 const (
 	ctlMsgProtoHandshake uint16 = 10
-	ctlMsgDiscCode       uint16 = 4
+	ctlMsgCapsUpdate     uint16 = 11
+	ctlMsgProtoTable     uint16 = 12
+	ctlMsgCapsAck        uint16 = 13
+	ctlMsgDiscCode       uint16 = 2
 	ctlMsgPingCode       uint16 = 3
 	ctlMsgPongCode       uint16 = 4
+
+	// Code the control messages of unknown codes are counted under in metrics.
+	ctlMsgUnknown uint16 = math.MaxUint16
+
+	// Maximum payload size of control frames, which carry small messages only.
+	maxCtlMsgSize = 64 * 1024
+)
+
+// Priority is the send priority of messages. High priority messages, such as block
+// announcements, are written to a peer before normal ones, such as bulk transfers.
+type Priority uint8
+
+const (
+	// PriorityNormal is the default priority
+	PriorityNormal Priority = iota
+	// PriorityHigh messages preempt queued normal ones
+	PriorityHigh
+
+	numPriorities = 2
 )
 
 // Message exposed for high level layer to call
@@ -23,10 +51,86 @@ type Message struct {
 	msgCode    uint16 // message code, defined in each protocol
 	size       uint32 // size of the paylod
 	payload    []byte
+	requestID  uint32   // stamped by SendRequest, responseFlag is set for response
+	priority   Priority // send priority, not transferred
 	ReceivedAt time.Time
 	CurPeer    *Peer // peer that handle this message
 }
 
+var (
+	errMsgSizeMismatch = errors.New("message size mismatch with payload length")
+	errTooManyCaps     = errors.New("too many caps in handshake")
+	errProtoTableDiff  = errors.New("protoCode table differs from remote")
+	errCtlMsgSize      = errors.New("unexpected payload size of control message")
+)
+
+// NewMessage creates a Message with msgCode, content is serialized as the payload.
+// A serialization error is returned to the caller, nothing will be sent.
+func NewMessage(msgCode uint16, content interface{}) (*Message, error) {
+	payload, err := common.Serialize(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		msgCode: msgCode,
+		size:    uint32(len(payload)),
+		payload: payload,
+	}, nil
+}
+
+// Code returns the message code defined by the protocol
+func (m *Message) Code() uint16 {
+	return m.msgCode
+}
+
+// SetPriority sets the send priority of the message and returns it. A message is sent
+// at the higher of its priority and the priority of its protocol.
+func (m *Message) SetPriority(priority Priority) *Message {
+	m.priority = priority
+	return m
+}
+
+// Decode deserializes the payload of the message into val
+func (m *Message) Decode(val interface{}) error {
+	return common.Deserialize(m.payload, val)
+}
+
+// validate checks the header matches the payload, so a corrupt frame is never sent
+func (m *Message) validate() error {
+	if int(m.size) != len(m.payload) {
+		return errMsgSizeMismatch
+	}
+
+	return nil
+}
+
+// knownCtlMsg reports whether msgCode is a control message handled by peers
+func knownCtlMsg(msgCode uint16) bool {
+	switch msgCode {
+	case ctlMsgDiscCode, ctlMsgPingCode, ctlMsgPongCode, ctlMsgProtoHandshake, ctlMsgCapsUpdate, ctlMsgProtoTable, ctlMsgCapsAck:
+		return true
+	}
+	return false
+}
+
+// validateCtlSize checks the payload size of a control frame. Known control messages
+// other than ping and pong carry a small payload. Ping, pong and unknown control
+// messages, which are ignored by handle, carry no payload.
+func validateCtlSize(msgCode uint16, size uint32) error {
+	switch msgCode {
+	case ctlMsgDiscCode, ctlMsgProtoHandshake, ctlMsgCapsUpdate, ctlMsgProtoTable, ctlMsgCapsAck:
+		if size == 0 || size > maxCtlMsgSize {
+			return errCtlMsgSize
+		}
+	default:
+		if size != 0 {
+			return errCtlMsgSize
+		}
+	}
+	return nil
+}
+
 // msg wrapped Message, used in p2p layer
 type msg struct {
 	Message
@@ -36,7 +140,91 @@ type msg struct {
 // protoHandShake handshake message for two peer to exchage base information
 // TODO add public key or other information for encryption?
 type protoHandShake struct {
-	caps   []Cap
-	nodeID discovery.NodeID
-	nounce uint32 //
+	Caps   []Cap
+	NodeID discovery.NodeID
+	Nounce uint32
+	// TCPPort is the advertised listen port, so that an inbound peer can be
+	// dialed back. Zero if the node does not listen on TCP.
+	TCPPort uint16
+	// NetworkID identifies the network of the node, peers of other networks are rejected.
+	NetworkID uint32
+}
+
+// capUpdate announces a protocol enabled after handshake with its protoCode
+type capUpdate struct {
+	Cap       Cap
+	ProtoCode uint16
+}
+
+// capAck answers a capUpdate, the announced cap is registered by both ends with
+// ProtoCode only if Accepted.
+type capAck struct {
+	Cap       Cap
+	ProtoCode uint16
+	Accepted  bool
+}
+
+// decodeHandshake decodes the handshake payload. Caps are counted before decoding,
+// so an over-long cap list is rejected without allocating for all of it.
+func decodeHandshake(payload []byte, maxCaps int) (*protoHandShake, error) {
+	s := rlp.NewStream(bytes.NewReader(payload), uint64(len(payload)))
+	if _, err := s.List(); err != nil {
+		return nil, err
+	}
+	// Caps is the first field of protoHandShake
+	if _, err := s.List(); err != nil {
+		return nil, err
+	}
+	for count := 0; ; count++ {
+		if _, err := s.Raw(); err == rlp.EOL {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if count >= maxCaps {
+			return nil, errTooManyCaps
+		}
+	}
+
+	hs := &protoHandShake{}
+	if err := common.Deserialize(payload, hs); err != nil {
+		return nil, err
+	}
+	return hs, nil
+}
+
+// negotiateProtoCodes returns the protoCode table of the caps supported by both
+// ends. Shared caps are ordered by name and version, so both ends compute the same
+// table regardless of the order protocols are registered.
+func negotiateProtoCodes(localCaps, remoteCaps []Cap) []capUpdate {
+	remote := make(map[Cap]bool)
+	for _, cap := range remoteCaps {
+		remote[cap] = true
+	}
+	var shared []Cap
+	for _, cap := range localCaps {
+		if remote[cap] {
+			shared = append(shared, cap)
+		}
+	}
+	sort.Sort(capsByNameAndVersion(shared))
+
+	table := make([]capUpdate, len(shared))
+	for i, cap := range shared {
+		table[i] = capUpdate{cap, uint16(baseProtoCode) + uint16(i)}
+	}
+	return table
+}
+
+// equalProtoTables reports whether the protoCode tables of both ends are the same
+func equalProtoTables(a, b []capUpdate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,63 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/common"
+)
+
+func newTestHandshakePayload(t *testing.T, capCount int) []byte {
+	hs := &protoHandShake{Nounce: 1}
+	for i := 0; i < capCount; i++ {
+		hs.Caps = append(hs.Caps, Cap{fmt.Sprintf("cap%d", i), 1})
+	}
+	payload, err := common.Serialize(hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func Test_DecodeHandshake(t *testing.T) {
+	hs, err := decodeHandshake(newTestHandshakePayload(t, 3), 3)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(hs.Caps), 3)
+	assert.Equal(t, hs.Caps[2].Name, "cap2")
+	assert.Equal(t, hs.Nounce, uint32(1))
+}
+
+func Test_DecodeHandshakeTooManyCaps(t *testing.T) {
+	payload := newTestHandshakePayload(t, 10000)
+
+	var err error
+	allocs := testing.AllocsPerRun(1, func() {
+		_, err = decodeHandshake(payload, 3)
+	})
+	assert.Equal(t, err, errTooManyCaps)
+	if allocs > 100 {
+		t.Fatalf("too many allocations %f for rejected handshake", allocs)
+	}
+}
+
+func Test_DecodeHandshakeMalformed(t *testing.T) {
+	_, err := decodeHandshake([]byte{0xff}, 3)
+	assert.Equal(t, err != nil, true)
+}
+
+func Test_NegotiateProtoCodes(t *testing.T) {
+	a, b, c := Cap{"a", 1}, Cap{"b", 1}, Cap{"c", 1}
+	table1 := negotiateProtoCodes([]Cap{c, a, b}, []Cap{b, a})
+	table2 := negotiateProtoCodes([]Cap{b, a}, []Cap{a, c, b})
+
+	// only shared caps in the same order at both ends
+	assert.Equal(t, table1, []capUpdate{{a, uint16(baseProtoCode)}, {b, uint16(baseProtoCode + 1)}})
+	assert.Equal(t, equalProtoTables(table1, table2), true)
+	assert.Equal(t, equalProtoTables(table1, table1[:1]), false)
+}
@@ -0,0 +1,227 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/aristanetworks/goarista/monotime"
+)
+
+// Keys of the server counters published by expvar
+const (
+	varPeers              = "peers"
+	varBytesIn            = "bytesIn"
+	varBytesOut           = "bytesOut"
+	varHandshakeSuccesses = "handshakeSuccesses"
+	varHandshakeFailures  = "handshakeFailures"
+	varDialsAttempted     = "dialsAttempted"
+	varDialsFailed        = "dialsFailed"
+)
+
+var varKeys = []string{varPeers, varBytesIn, varBytesOut, varHandshakeSuccesses, varHandshakeFailures, varDialsAttempted, varDialsFailed}
+
+// sessionBounds are the upper bounds of the peer session duration buckets
+var sessionBounds = []time.Duration{
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// Histogram is a snapshot of durations counted in buckets
+type Histogram struct {
+	Bounds []time.Duration // upper bounds of buckets
+	Counts []uint64        // counts of buckets, the last one counts durations beyond all bounds
+	Count  uint64
+	Sum    time.Duration
+}
+
+func newHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		Bounds: bounds,
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) add(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h *Histogram) copy() Histogram {
+	return Histogram{
+		Bounds: append([]time.Duration(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Count:  h.Count,
+		Sum:    h.Sum,
+	}
+}
+
+// MsgType identifies the messages of a protocol by the codes in frame header.
+// Control messages of unknown codes share the MsgCode math.MaxUint16.
+type MsgType struct {
+	ProtoCode uint16
+	MsgCode   uint16
+}
+
+// MsgStats are the number of messages and their total bytes including frame headers
+type MsgStats struct {
+	Count uint64
+	Bytes uint64
+}
+
+// Metrics is a snapshot of the server metrics
+type Metrics struct {
+	Churn       uint64          // number of peers disconnected
+	Sessions    Histogram       // durations of peer sessions
+	DiscReasons map[uint]uint64 // number of peers disconnected by reason
+
+	Sent     map[MsgType]MsgStats // messages sent to all peers
+	Received map[MsgType]MsgStats // messages received from all peers
+}
+
+type serverMetrics struct {
+	lock        sync.Mutex
+	churn       uint64
+	sessions    *Histogram
+	discReasons map[uint]uint64
+	sent        map[MsgType]MsgStats
+	received    map[MsgType]MsgStats
+	vars        *expvar.Map // counters published by expvar, nil if not published
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		sessions:    newHistogram(sessionBounds),
+		discReasons: make(map[uint]uint64),
+		sent:        make(map[MsgType]MsgStats),
+		received:    make(map[MsgType]MsgStats),
+	}
+}
+
+// metricsVarName returns the expvar name of the counters of the server of name
+// and nodeID. The node ID keeps servers of the same name, or of the default empty
+// name, in one process apart.
+func metricsVarName(name, nodeID string) string {
+	return "p2p." + name + "." + nodeID
+}
+
+// publish publishes the counters by expvar as a map named "p2p.<name>.<nodeID>", so
+// they appear at /debug/vars. expvar names can not be unregistered, so the map
+// published by a former Start of the same node is reset and reused.
+func (m *serverMetrics) publish(name, nodeID string) {
+	varName := metricsVarName(name, nodeID)
+	vars, ok := expvar.Get(varName).(*expvar.Map)
+	if !ok {
+		vars = expvar.NewMap(varName)
+	}
+	vars.Init()
+	for _, key := range varKeys {
+		vars.Set(key, new(expvar.Int))
+	}
+	m.vars = vars
+}
+
+// addVar adds delta to the published counter of key, m can be nil
+func (m *serverMetrics) addVar(key string, delta int64) {
+	if m == nil || m.vars == nil {
+		return
+	}
+	m.vars.Add(key, delta)
+}
+
+// setVar sets the published counter of key, m can be nil
+func (m *serverMetrics) setVar(key string, value int64) {
+	if m == nil || m.vars == nil {
+		return
+	}
+	if v, ok := m.vars.Get(key).(*expvar.Int); ok {
+		v.Set(value)
+	}
+}
+
+// msgSent records a frame written to a peer, m can be nil
+func (m *serverMetrics) msgSent(frame *msg) {
+	if m == nil {
+		return
+	}
+	m.addVar(varBytesOut, int64(headerSize)+int64(frame.size))
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	addMsgStats(m.sent, frame)
+}
+
+// msgReceived records a frame read from a peer, m can be nil
+func (m *serverMetrics) msgReceived(frame *msg) {
+	if m == nil {
+		return
+	}
+	m.addVar(varBytesIn, int64(headerSize)+int64(frame.size))
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	addMsgStats(m.received, frame)
+}
+
+// addMsgStats counts frame in stats. Control frames of unknown codes are counted
+// together, so that a remote can not grow stats by sending arbitrary codes.
+func addMsgStats(stats map[MsgType]MsgStats, frame *msg) {
+	key := MsgType{frame.protoCode, frame.msgCode}
+	if frame.protoCode == ctlProtoCode && !knownCtlMsg(frame.msgCode) {
+		key.MsgCode = ctlMsgUnknown
+	}
+	s := stats[key]
+	s.Count++
+	s.Bytes += uint64(headerSize) + uint64(frame.size)
+	stats[key] = s
+}
+
+func copyMsgStats(stats map[MsgType]MsgStats) map[MsgType]MsgStats {
+	c := make(map[MsgType]MsgStats, len(stats))
+	for key, s := range stats {
+		c[key] = s
+	}
+	return c
+}
+
+// peerDisconnected records the session of a quit peer
+func (m *serverMetrics) peerDisconnected(p *Peer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.churn++
+	m.sessions.add(time.Duration(monotime.Now() - p.created))
+	if reason, ok := p.discReason(); ok {
+		m.discReasons[reason]++
+	}
+}
+
+func (m *serverMetrics) snapshot() *Metrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	metrics := &Metrics{
+		Churn:       m.churn,
+		Sessions:    m.sessions.copy(),
+		DiscReasons: make(map[uint]uint64, len(m.discReasons)),
+		Sent:        copyMsgStats(m.sent),
+		Received:    copyMsgStats(m.received),
+	}
+	for reason, count := range m.discReasons {
+		metrics.DiscReasons[reason] = count
+	}
+	return metrics
+}
@@ -0,0 +1,148 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+func Test_Histogram(t *testing.T) {
+	h := newHistogram([]time.Duration{time.Second, time.Minute})
+	h.add(time.Millisecond)
+	h.add(time.Second)
+	h.add(2 * time.Second)
+	h.add(time.Hour)
+
+	assert.Equal(t, h.Counts, []uint64{2, 1, 1})
+	assert.Equal(t, h.Count, uint64(4))
+	assert.Equal(t, h.Sum, time.Hour+3*time.Second+time.Millisecond)
+
+	// snapshot is not changed by later samples
+	snapshot := h.copy()
+	h.add(time.Millisecond)
+	assert.Equal(t, snapshot.Counts, []uint64{2, 1, 1})
+}
+
+func Test_Metrics_MsgStats(t *testing.T) {
+	p1, p2 := newTestPeerPair(newTestProtocol("a"), newTestProtocol("b"))
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+	sender, receiver := newServerMetrics(), newServerMetrics()
+	p1.metrics, p2.metrics = sender, receiver
+
+	frames := []*msg{
+		{protoCode: 8, Message: Message{msgCode: 1, size: 10, payload: make([]byte, 10)}},
+		{protoCode: 8, Message: Message{msgCode: 1, size: 20, payload: make([]byte, 20)}},
+		{protoCode: 8, Message: Message{msgCode: 2, size: 5, payload: make([]byte, 5)}},
+		{protoCode: 9, Message: Message{msgCode: 1}},
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, frame := range frames {
+			p1.sendRawMsg(frame)
+		}
+		close(done)
+	}()
+	for range frames {
+		_, err := p2.recvRawMsg()
+		assert.Equal(t, err, nil)
+	}
+	<-done
+
+	expected := map[MsgType]MsgStats{
+		{8, 1}: {2, 2*headerSize + 30},
+		{8, 2}: {1, headerSize + 5},
+		{9, 1}: {1, headerSize},
+	}
+	assert.Equal(t, receiver.snapshot().Received, expected)
+	assert.Equal(t, sender.snapshot().Sent, expected)
+	assert.Equal(t, len(sender.snapshot().Received), 0)
+}
+
+func Test_Metrics_UnknownCtlMsgs(t *testing.T) {
+	m := newServerMetrics()
+	for code := uint16(100); code < 110; code++ {
+		m.msgReceived(&msg{protoCode: ctlProtoCode, Message: Message{msgCode: code}})
+	}
+	m.msgReceived(&msg{protoCode: ctlProtoCode, Message: Message{msgCode: ctlMsgPingCode}})
+
+	// unknown control codes are counted together
+	expected := map[MsgType]MsgStats{
+		{ctlProtoCode, ctlMsgUnknown}:  {10, 10 * headerSize},
+		{ctlProtoCode, ctlMsgPingCode}: {1, headerSize},
+	}
+	assert.Equal(t, m.snapshot().Received, expected)
+}
+
+func Test_Metrics_Expvar(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	srv.Name = "expvartest"
+	node, unreachable := newTestNode(t), newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node, unreachable}
+	srv.DialJitter = -1
+	dialer := &testDialer{addrs: make(chan string, 16)}
+	srv.Dialer = dialer
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+	<-dialer.addrs
+	<-dialer.addrs
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	proto.waitAdded(t)
+
+	vars := expvar.Get(metricsVarName("expvartest", srv.MyNodeID)).(*expvar.Map)
+	value := func(key string) int64 {
+		return vars.Get(key).(*expvar.Int).Value()
+	}
+	deadline := time.Now().Add(time.Second)
+	for value(varPeers) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("peer is not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, value(varHandshakeSuccesses), int64(1))
+	assert.Equal(t, value(varHandshakeFailures), int64(0))
+	assert.Equal(t, value(varDialsAttempted) >= 2, true)
+	assert.Equal(t, value(varDialsFailed) >= 1, true)
+	// handshake and protoCode table frames in each direction
+	assert.Equal(t, value(varBytesIn) > 2*int64(headerSize), true)
+	assert.Equal(t, value(varBytesOut) > 2*int64(headerSize), true)
+
+	// another server of the same name publishes its own counters
+	srv2 := newTestServer(t)
+	srv2.Name = srv.Name
+	assert.Equal(t, srv2.Start(), nil)
+	defer srv2.Stop()
+	assert.Equal(t, value(varHandshakeSuccesses), int64(1))
+	vars2 := expvar.Get(metricsVarName(srv2.Name, srv2.MyNodeID)).(*expvar.Map)
+	assert.Equal(t, vars2.Get(varHandshakeSuccesses).(*expvar.Int).Value(), int64(0))
+}
+
+func Test_Metrics_ExpvarRestart(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Name = ""
+	assert.Equal(t, srv.Start(), nil)
+	vars := expvar.Get(metricsVarName("", srv.MyNodeID)).(*expvar.Map)
+	vars.Add(varHandshakeSuccesses, 3)
+	srv.Stop()
+
+	// a restarted server resets and reuses its counters instead of panicking
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+	assert.Equal(t, expvar.Get(metricsVarName("", srv.MyNodeID)).(*expvar.Map), vars)
+	assert.Equal(t, vars.Get(varHandshakeSuccesses).(*expvar.Int).Value(), int64(0))
+}
@@ -0,0 +1,81 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/seeleteam/go-seele/common"
+)
+
+// Time a handshake nonce of a remote node is remembered.
+const nonceWindow = 10 * time.Minute
+
+var (
+	errZeroNonce   = errors.New("zero handshake nonce")
+	errReusedNonce = errors.New("reused handshake nonce")
+)
+
+// nonceHistory records the handshake nonces of remote nodes seen recently, so
+// that a replayed handshake is rejected. Expired nonces of all nodes are swept
+// once per nonceWindow, so nodes that never come back are not kept.
+type nonceHistory struct {
+	lock      sync.Mutex
+	seen      map[common.Address]map[uint32]time.Time // node ID => nonce => expiry
+	nextSweep time.Time
+}
+
+func newNonceHistory() *nonceHistory {
+	return &nonceHistory{
+		seen: make(map[common.Address]map[uint32]time.Time),
+	}
+}
+
+// check records nonce of id at now, it returns an error if nonce is zero or
+// was seen from id within nonceWindow.
+func (h *nonceHistory) check(id common.Address, nonce uint32, now time.Time) error {
+	if nonce == 0 {
+		return errZeroNonce
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !now.Before(h.nextSweep) {
+		for n := range h.seen {
+			h.expire(n, now)
+		}
+		h.nextSweep = now.Add(nonceWindow)
+	} else {
+		h.expire(id, now)
+	}
+
+	nonces := h.seen[id]
+	if nonces == nil {
+		nonces = make(map[uint32]time.Time)
+		h.seen[id] = nonces
+	}
+	if _, ok := nonces[nonce]; ok {
+		return errReusedNonce
+	}
+	nonces[nonce] = now.Add(nonceWindow)
+	return nil
+}
+
+// expire removes the nonces of id expired at now, and id once it has none
+func (h *nonceHistory) expire(id common.Address, now time.Time) {
+	nonces := h.seen[id]
+	for n, expiry := range nonces {
+		if !now.Before(expiry) {
+			delete(nonces, n)
+		}
+	}
+	if len(nonces) == 0 {
+		delete(h.seen, id)
+	}
+}
@@ -0,0 +1,41 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/common"
+)
+
+func Test_NonceHistory(t *testing.T) {
+	h := newNonceHistory()
+	id1, id2 := common.Address{1}, common.Address{2}
+	now := time.Now()
+
+	assert.Equal(t, h.check(id1, 0, now), errZeroNonce)
+	assert.Equal(t, h.check(id1, 7, now), nil)
+	assert.Equal(t, h.check(id1, 7, now), errReusedNonce)
+	assert.Equal(t, h.check(id2, 7, now), nil)
+	assert.Equal(t, h.check(id1, 7, now.Add(nonceWindow)), nil)
+}
+
+func Test_NonceHistory_Sweep(t *testing.T) {
+	h := newNonceHistory()
+	id1, id2 := common.Address{1}, common.Address{2}
+	now := time.Now()
+
+	assert.Equal(t, h.check(id1, 7, now), nil)
+	assert.Equal(t, len(h.seen), 1)
+
+	// the expired nonce of id1 is swept by a check of another node
+	assert.Equal(t, h.check(id2, 7, now.Add(nonceWindow)), nil)
+	assert.Equal(t, len(h.seen), 1)
+	_, ok := h.seen[id1]
+	assert.Equal(t, ok, false)
+}
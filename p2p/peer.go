@@ -11,9 +11,12 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/aristanetworks/goarista/monotime"
+	"github.com/seeleteam/go-seele/common"
 	"github.com/seeleteam/go-seele/log"
 	"github.com/seeleteam/go-seele/p2p/discovery"
 )
@@ -22,24 +25,156 @@ const (
 	pingInterval         = 3 * time.Second // ping interval for peer tcp connection. Should be 15
 	discAlreadyConnected = 10              // node already has connection
 	discServerQuit       = 11              // p2p.server need quit, all peers should quit as it can
+	discProtocolError    = 12              // remote sent a frame that can not be handled
+	discHandshakeReject  = 13              // handshake rejected by application validator
+	discSlowRead         = 14              // remote sent a frame payload slower than the throughput floor
+	discTooManyPeers     = 15              // no peer slot left for the connection
+	discMsgFlood         = 16              // remote sent frames faster than the rate limit
+	discBusy             = 17              // server is paused and does not accept new peers
+	discNetworkMismatch  = 18              // remote is of another network
+	discImpersonation    = 19              // remote answered a dial with another node ID
+	discUselessPeer      = 20              // no protocol is shared with the remote
+
+	// Delay before writing a stalled control message again.
+	ctlWriteRetryDelay = 200 * time.Millisecond
+
+	// Maximum amount of time waiting for the remote to answer an announced cap.
+	capAckTimeout = 10 * time.Second
+
+	// Maximum amount of time allowed for telling the remote why it is disconnected.
+	discWriteTimeout = 1 * time.Second
+
+	// Default minimum throughput of frame payload reads, bytes per second.
+	defaultMinReadThroughput = 1024
+
+	// Time allowed for a frame payload read in addition to its size at the throughput floor.
+	defaultReadThroughputGrace = 5 * time.Second
+
+	// Default maximum rate of protocol frames received, frames per second.
+	defaultMaxMsgRate = 1000
+
+	// Maximum rate of control frames received, frames per second. It is generous
+	// for keepalive, and separate so that protocol frames do not starve it.
+	ctlMsgRate = 50
+
+	// frame header: magic(2) size(4) protoCode(2) msgCode(2) requestID(4)
+	headerSize = 14
+
+	// headerMagic starts every frame, it identifies seele connections and the frame
+	// version, so that connections of other protocols are rejected at the first frame.
+	headerMagic uint16 = 0x5e01
 )
 
+var (
+	errDiscRequested  = errors.New("disconnect requested")
+	errRemoteDisc     = errors.New("disconnected by remote")
+	errCtlProtoCode   = errors.New("protocol can not send message on control protoCode")
+	errMsgCodeRange   = errors.New("msgCode is out of protocol range")
+	errSlowRead       = errors.New("frame payload read below throughput floor")
+	errHeaderMagic    = errors.New("frame header magic mismatch")
+	errMsgFlood       = errors.New("frames received faster than rate limit")
+	errProtoNotShared = errors.New("protocol is not negotiated with peer")
+	errMsgTooLarge    = errors.New("message size exceeds protocol limit")
+	errCapRejected    = errors.New("announced protocol rejected by peer")
+	errCapAckTimeout  = errors.New("announced protocol not answered by peer")
+
+	// errWriteStalled is returned if the write deadline expires before any byte of
+	// the frame is written, e.g. the socket buffer is full for a while. The
+	// connection is still in sync, so the frame can be written again.
+	errWriteStalled = errors.New("frame write stalled")
+)
+
+// peerError is the terminating error of a peer with its disconnect reason
+type peerError struct {
+	reason uint
+	err    error
+}
+
+func newPeerError(reason uint, err error) *peerError {
+	return &peerError{reason: reason, err: err}
+}
+
+func (e *peerError) Error() string {
+	return fmt.Sprintf("%s, reason=%d", e.err, e.reason)
+}
+
+// discReason returns the disconnect reason of the peer after it quits, false if
+// it quits for other errors such as network failures.
+func (p *Peer) discReason() (uint, bool) {
+	if perr, ok := p.err.(*peerError); ok {
+		return perr.reason, true
+	}
+	return 0, false
+}
+
 // Peer represents a connected remote node.
 type Peer struct {
 	conn     net.Conn        // tcp connection
 	node     *discovery.Node // remote peer that this peer connects
+	inbound  bool            // connected by the remote
 	created  uint64          // Peer create time, nanosecond
 	err      error
-	closed   chan struct{}
-	disc     chan uint
+	closed   chan struct{}        // closed when the peer quits, it is never reopened
+	disc     chan uint            // never closed, see Disconnect
 	protoMap map[uint16]*Protocol // protoCode=>proto
 	capMap   map[string]uint16    // cap of protocol => protoCode
+	capLock  sync.RWMutex         // for protoMap, capMap and announcing, caps can be added after handshake
+
+	// announcing are the caps announced to the remote and not answered yet by protoCode
+	announcing map[uint16]*capAnnounce
+
+	// joined are the protocols received the peer by AddPeerCh, they receive it by
+	// DelPeerCh exactly once when the peer quits. No protocol joins after left.
+	joined   []*Protocol
+	left     bool
+	joinLock sync.Mutex // for joined and left
+
+	// lookupProto finds a local protocol by cap, for caps announced after handshake
+	lookupProto func(cap Cap) *Protocol
+
+	lastRequestID uint32                   // accessed atomically
+	pending       map[uint32]chan *Message // requestID => waiting response
+	pendingLock   sync.Mutex               // for pending
+
+	// minReadThroughput is the floor of frame payload reads in bytes per second,
+	// non-positive disables it. readGrace is the extra time allowed for each payload.
+	minReadThroughput int
+	readGrace         time.Duration
+
+	// maxMsgRate is the maximum rate of protocol frames received per second,
+	// non-positive disables it. Control frames are limited by ctlMsgRate.
+	maxMsgRate int
+
+	metrics   *serverMetrics // records frames sent and received, can be nil
+	sendQueue *sendQueue     // frames of protocols, written by writeLoop
+	wMutex    sync.Mutex     // for conn write
+	wg        sync.WaitGroup
+	log       *log.SeeleLog
+}
+
+func newPeer(conn net.Conn, log *log.SeeleLog) *Peer {
+	return &Peer{
+		conn:     conn,
+		created:  monotime.Now(),
+		disc:     make(chan uint),
+		closed:   make(chan struct{}),
+		protoMap: make(map[uint16]*Protocol),
+		capMap:   make(map[string]uint16),
+		pending:  make(map[uint32]chan *Message),
+		log:      log,
 
-	wMutex sync.Mutex // for conn write
-	wg     sync.WaitGroup
-	log    *log.SeeleLog
+		sendQueue:  newSendQueue(),
+		announcing: make(map[uint16]*capAnnounce),
+
+		minReadThroughput: defaultMinReadThroughput,
+		readGrace:         defaultReadThroughputGrace,
+		maxMsgRate:        defaultMaxMsgRate,
+	}
 }
 
+// run runs the peer until it quits. Protocols receive the peer by AddPeerCh
+// and then by DelPeerCh exactly once when it quits. Once quit, the peer stops
+// delivering messages and a delivery blocked on ReadMsgCh is dropped.
 func (p *Peer) run() {
 	// add peer to protocols
 	var (
@@ -47,53 +182,72 @@ func (p *Peer) run() {
 		readErr  = make(chan error, 1)
 		err      error
 	)
-	for _, proto := range p.protoMap {
-		proto.AddPeerCh <- p
+	// writes start before joining, as protocols may send to the peer, e.g. by
+	// Broadcast, before they receive it. Reads start after, so that protocols
+	// receive the peer before its messages.
+	p.wg.Add(3)
+	go p.writeLoop(writeErr)
+	go p.pingLoop(writeErr)
+	for _, proto := range p.protocols() {
+		p.joinProtocol(proto)
 	}
-
-	p.wg.Add(2)
 	go p.readLoop(readErr)
-	go p.pingLoop()
 
 	// Wait for an error or disconnect.
 loop:
 	for {
 		select {
 		case err = <-writeErr:
-			// A write finished. Allow the next write to start if
-			// there was no error.
-			if err != nil {
-				p.err = err
-				break loop
-			}
+			// writeLoop and pingLoop only report failed writes
+			p.err = err
+			break loop
 		case err = <-readErr:
 			p.err = err
 			break loop
-		case <-p.disc:
-			p.err = errors.New("disc error recved")
+		case reason := <-p.disc:
+			p.err = newPeerError(reason, errDiscRequested)
 			break loop
 		}
 	}
 
+	// tell the remote why, unless it is the one who disconnected
+	if perr, ok := p.err.(*peerError); ok && perr.err != errRemoteDisc {
+		p.sendDiscMsg(perr.reason)
+	}
+
+	// disc is never closed since Disconnect may be sending on it concurrently,
+	// closed is the only done signal and senders select on it.
 	close(p.closed)
 	p.conn.Close()
-	close(p.disc)
 	p.wg.Wait()
-	// send delpeer message for each protocols
-	for _, proto := range p.protoMap {
-		proto.DelPeerCh <- p
+	// send delpeer message for each joined protocols
+	p.joinLock.Lock()
+	p.left = true
+	joined := p.joined
+	p.joinLock.Unlock()
+	for _, proto := range joined {
+		select {
+		case proto.DelPeerCh <- p:
+		case <-proto.done:
+		}
 	}
-	p.log.Info("p2p.peer.run quit. err=%s", p.err)
+	p.log.Debug("p2p.peer.run quit. err=%s", p.err)
 }
 
-func (p *Peer) pingLoop() {
+func (p *Peer) pingLoop(errc chan<- error) {
 	ping := time.NewTimer(pingInterval)
 	defer p.wg.Done()
 	defer ping.Stop()
 	for {
 		select {
 		case <-ping.C:
-			p.sendCtlMsg(ctlMsgPingCode)
+			if err := p.sendCtlMsg(ctlMsgPingCode); err != nil {
+				select {
+				case errc <- err:
+				default:
+				}
+				return
+			}
 			ping.Reset(pingInterval)
 		case <-p.closed:
 			return
@@ -103,12 +257,25 @@ func (p *Peer) pingLoop() {
 
 func (p *Peer) readLoop(errc chan<- error) {
 	defer p.wg.Done()
+	var msgLimiter *rateLimiter
+	if p.maxMsgRate > 0 {
+		msgLimiter = newRateLimiter(p.maxMsgRate, time.Now())
+	}
+	ctlLimiter := newRateLimiter(ctlMsgRate, time.Now())
 	for {
 		msgRecv, err := p.recvRawMsg()
 		if err != nil {
 			errc <- err
 			return
 		}
+		limiter := msgLimiter
+		if msgRecv.protoCode == ctlProtoCode {
+			limiter = ctlLimiter
+		}
+		if limiter != nil && !limiter.allow(time.Now()) {
+			errc <- newPeerError(discMsgFlood, errMsgFlood)
+			return
+		}
 		if err = p.handle(msgRecv); err != nil {
 			errc <- err
 			return
@@ -116,43 +283,408 @@ func (p *Peer) readLoop(errc chan<- error) {
 	}
 }
 
+// writeLoop writes the queued frames of protocols until the peer quits.
+// Frames not written are completed with errPeerDisconnected.
+func (p *Peer) writeLoop(errc chan<- error) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.sendQueue.wake:
+		case <-p.closed:
+		}
+
+		for req := p.sendQueue.pop(); req != nil; req = p.sendQueue.pop() {
+			select {
+			case <-p.closed:
+				req.done(errPeerDisconnected)
+				continue
+			default:
+			}
+			err := p.sendRawMsg(req.msg)
+			req.done(err)
+			if err != nil {
+				select {
+				case errc <- err:
+				default:
+				}
+			}
+		}
+
+		select {
+		case <-p.closed:
+			for _, req := range p.sendQueue.close() {
+				req.done(errPeerDisconnected)
+			}
+			return
+		default:
+		}
+	}
+}
+
 func (p *Peer) handle(msgRecv *msg) error {
+	if msgRecv.requestID&responseFlag != 0 {
+		p.deliverResponse(&msgRecv.Message)
+		return nil
+	}
+
+	p.capLock.RLock()
 	proto, ok := p.protoMap[msgRecv.protoCode]
+	p.capLock.RUnlock()
 	if ok {
 		select {
 		case proto.ReadMsgCh <- &(msgRecv.Message):
 			return nil
+		case <-proto.done:
+			// the protocol quit, its messages are dropped
+			return nil
 		case <-p.closed:
 			return io.EOF
 		}
 	}
 
-	if msgRecv.protoCode != 1 {
-		return errors.New("not valid protoCode")
+	if msgRecv.protoCode != ctlProtoCode {
+		return newPeerError(discProtocolError, fmt.Errorf("not valid protoCode %d", msgRecv.protoCode))
 	}
 	// for control msg
-	switch {
-	case msgRecv.msgCode == ctlMsgPingCode:
+	switch msgRecv.msgCode {
+	case ctlMsgPingCode:
 		go p.sendCtlMsg(ctlMsgPongCode)
-	case msgRecv.msgCode == ctlMsgDiscCode:
-		return fmt.Errorf("error=%d", ctlMsgDiscCode)
+	case ctlMsgDiscCode:
+		var reason uint
+		if err := msgRecv.Decode(&reason); err != nil {
+			return newPeerError(discProtocolError, err)
+		}
+		return newPeerError(reason, errRemoteDisc)
+	case ctlMsgCapsUpdate:
+		var updates []capUpdate
+		if err := msgRecv.Decode(&updates); err != nil {
+			return newPeerError(discProtocolError, err)
+		}
+		acks := make([]capAck, 0, len(updates))
+		var added []*Protocol
+		for _, update := range updates {
+			if update.ProtoCode < uint16(baseProtoCode) {
+				return newPeerError(discProtocolError, fmt.Errorf("not valid protoCode %d", update.ProtoCode))
+			}
+			accepted := false
+			if p.lookupProto != nil {
+				if proto := p.lookupProto(update.Cap); proto != nil && p.registerProtocol(proto, update.ProtoCode) {
+					accepted = true
+					added = append(added, proto)
+				}
+			}
+			acks = append(acks, capAck{update.Cap, update.ProtoCode, accepted})
+		}
+		// protocols join after the ack is written, so that their frames do not
+		// arrive before the remote registers the cap. Not written inline, as the
+		// remote may be writing to us at the same time.
+		go func() {
+			if err := p.sendCapAcks(acks); err != nil {
+				return
+			}
+			for _, proto := range added {
+				p.joinProtocol(proto)
+			}
+		}()
+	case ctlMsgCapsAck:
+		var acks []capAck
+		if err := msgRecv.Decode(&acks); err != nil {
+			return newPeerError(discProtocolError, err)
+		}
+		for _, ack := range acks {
+			if err := p.capAnswered(ack); err != nil {
+				return newPeerError(discProtocolError, err)
+			}
+		}
 	}
 	return nil
 }
 
-// SendMsg called by protocols
-func (p *Peer) SendMsg(proto *Protocol, msgSend *Message) error {
+// capAnswered completes the announcement answered by ack. A cap accepted by the
+// remote is registered with the announced protoCode.
+func (p *Peer) capAnswered(ack capAck) error {
+	p.capLock.Lock()
+	a, ok := p.announcing[ack.ProtoCode]
+	if !ok || a.proto.cap() != ack.Cap {
+		p.capLock.Unlock()
+		return fmt.Errorf("unexpected ack of cap %s with protoCode %d", ack.Cap, ack.ProtoCode)
+	}
+	delete(p.announcing, ack.ProtoCode)
+	if ack.Accepted {
+		p.protoMap[ack.ProtoCode] = a.proto
+		p.capMap[a.proto.cap().String()] = ack.ProtoCode
+	}
+	p.capLock.Unlock()
+
+	a.result <- ack.Accepted
+	return nil
+}
+
+func (p *Peer) sendCapAcks(acks []capAck) error {
+	payload, err := common.Serialize(acks)
+	if err != nil {
+		return err
+	}
+	ackMsg := &msg{
+		protoCode: ctlProtoCode,
+		Message: Message{
+			msgCode: ctlMsgCapsAck,
+			size:    uint32(len(payload)),
+			payload: payload,
+		},
+	}
+	return p.sendRawMsg(ackMsg)
+}
+
+// protocols returns the protocols of the peer
+func (p *Peer) protocols() []*Protocol {
+	p.capLock.RLock()
+	defer p.capLock.RUnlock()
+
+	protos := make([]*Protocol, 0, len(p.protoMap))
+	for _, proto := range p.protoMap {
+		protos = append(protos, proto)
+	}
+	return protos
+}
+
+// Caps returns the caps negotiated with the peer, which are supported at both ends,
+// in the order of their protoCodes.
+func (p *Peer) Caps() []Cap {
+	p.capLock.RLock()
+	defer p.capLock.RUnlock()
+
+	codes := make([]int, 0, len(p.protoMap))
+	for code := range p.protoMap {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	caps := make([]Cap, 0, len(codes))
+	for _, code := range codes {
+		caps = append(caps, p.protoMap[uint16(code)].cap())
+	}
+	return caps
+}
+
+// addProtocol registers proto with protoCode after handshake and sends the peer
+// to proto. It returns false if not added, see registerProtocol.
+func (p *Peer) addProtocol(proto *Protocol, protoCode uint16) bool {
+	if !p.registerProtocol(proto, protoCode) {
+		return false
+	}
+	p.joinProtocol(proto)
+	return true
+}
+
+// registerProtocol routes the frames of protoCode to proto. Registered or announced
+// protoCodes and caps are never replaced, so in-flight frames are not routed to
+// another protocol. It returns false if not registered.
+func (p *Peer) registerProtocol(proto *Protocol, protoCode uint16) bool {
+	p.capLock.Lock()
+	defer p.capLock.Unlock()
+
+	_, codeUsed := p.protoMap[protoCode]
+	_, codeAnnounced := p.announcing[protoCode]
+	if codeUsed || codeAnnounced || p.hasCapLocked(proto.cap()) {
+		return false
+	}
+	p.protoMap[protoCode] = proto
+	p.capMap[proto.cap().String()] = protoCode
+	return true
+}
+
+// hasCapLocked returns whether cap is registered or announced, capLock must be held
+func (p *Peer) hasCapLocked(cap Cap) bool {
+	if _, ok := p.capMap[cap.String()]; ok {
+		return true
+	}
+	for _, a := range p.announcing {
+		if a.proto.cap() == cap {
+			return true
+		}
+	}
+	return false
+}
+
+// joinProtocol sends the peer to proto by AddPeerCh unless the peer quits
+func (p *Peer) joinProtocol(proto *Protocol) {
+	p.joinLock.Lock()
+	defer p.joinLock.Unlock()
+	if p.left {
+		return
+	}
+
+	select {
+	case proto.AddPeerCh <- p:
+		p.joined = append(p.joined, proto)
+	case <-proto.done:
+	case <-p.closed:
+	}
+}
+
+// capAnnounce is a cap announced to the remote, result receives whether it is accepted
+type capAnnounce struct {
+	proto  *Protocol
+	result chan bool
+}
+
+// announceProtocol announces proto to the remote with a free protoCode, and registers
+// it once the remote accepts it with the same protoCode. Outbound and inbound ends
+// announce even and odd protoCodes respectively, so that protocols announced by both
+// ends at the same time never get the same protoCode.
+func (p *Peer) announceProtocol(proto *Protocol) error {
+	p.capLock.Lock()
+	if p.hasCapLocked(proto.cap()) {
+		p.capLock.Unlock()
+		return fmt.Errorf("protocol %s already added", proto.cap())
+	}
+	protoCode := uint16(baseProtoCode)
+	for code := range p.protoMap {
+		if code >= protoCode {
+			protoCode = code + 1
+		}
+	}
+	for code := range p.announcing {
+		if code >= protoCode {
+			protoCode = code + 1
+		}
+	}
+	if (protoCode%2 == 1) != p.inbound {
+		protoCode++
+	}
+	a := &capAnnounce{proto, make(chan bool, 1)}
+	p.announcing[protoCode] = a
+	p.capLock.Unlock()
+
+	payload, err := common.Serialize([]capUpdate{{proto.cap(), protoCode}})
+	if err == nil {
+		err = p.sendRawMsg(&msg{
+			protoCode: ctlProtoCode,
+			Message: Message{
+				msgCode: ctlMsgCapsUpdate,
+				size:    uint32(len(payload)),
+				payload: payload,
+			},
+		})
+	}
+	if err != nil {
+		p.cancelAnnounce(protoCode)
+		return err
+	}
+
+	// an ack arriving after the timeout is unexpected, and disconnects the peer
+	timer := time.NewTimer(capAckTimeout)
+	defer timer.Stop()
+	select {
+	case accepted := <-a.result:
+		if !accepted {
+			return errCapRejected
+		}
+		p.joinProtocol(proto)
+		return nil
+	case <-timer.C:
+		p.cancelAnnounce(protoCode)
+		return errCapAckTimeout
+	case <-p.closed:
+		return errPeerDisconnected
+	}
+}
+
+// cancelAnnounce forgets the announcement of protoCode
+func (p *Peer) cancelAnnounce(protoCode uint16) {
+	p.capLock.Lock()
+	delete(p.announcing, protoCode)
+	p.capLock.Unlock()
+}
+
+// protoCode returns the protoCode of proto, false if the peer does not support it
+func (p *Peer) protoCode(proto *Protocol) (uint16, bool) {
+	p.capLock.RLock()
+	defer p.capLock.RUnlock()
+
 	protoCode, ok := p.capMap[proto.cap().String()]
+	return protoCode, ok
+}
+
+// SendMsg called by protocols. A malformed message is rejected with an error
+// rather than written as a corrupt frame. Messages of the same protocol and priority
+// are written in the order SendMsg is called, and it returns after the write.
+func (p *Peer) SendMsg(proto *Protocol, msgSend *Message) error {
+	return p.sendProtoMsg(proto, msgSend, 0)
+}
+
+// SendMsgAsync queues msgSend to be sent to the remote peer without waiting for
+// the write, done is called with the write result. done is called from the write
+// goroutine of the peer and must not block.
+func (p *Peer) SendMsgAsync(proto *Protocol, msgSend *Message, done func(error)) {
+	msgRaw, err := p.newProtoMsg(proto, msgSend, 0)
+	if err != nil {
+		done(err)
+		return
+	}
+	p.queueMsgAsync(msgRaw, done)
+}
+
+func (p *Peer) sendProtoMsg(proto *Protocol, msgSend *Message, requestID uint32) error {
+	msgRaw, err := p.newProtoMsg(proto, msgSend, requestID)
+	if err != nil {
+		return err
+	}
+	return p.queueMsg(msgRaw)
+}
+
+// newProtoMsg validates msgSend and makes the frame of it for proto
+func (p *Peer) newProtoMsg(proto *Protocol, msgSend *Message, requestID uint32) (*msg, error) {
+	if err := msgSend.validate(); err != nil {
+		return nil, err
+	}
+	protoCode, ok := p.protoCode(proto)
 	if !ok {
-		return errors.New("Not Found protoCode")
+		return nil, errProtoNotShared
+	}
+	if protoCode == ctlProtoCode {
+		return nil, errCtlProtoCode
+	}
+	if proto.Length > 0 && msgSend.msgCode >= proto.Length {
+		return nil, errMsgCodeRange
+	}
+	if proto.MaxMsgSize > 0 && msgSend.size > proto.MaxMsgSize {
+		return nil, errMsgTooLarge
 	}
 	msgRaw := &msg{
 		protoCode: protoCode,
 		Message:   *msgSend,
 	}
-	return p.sendRawMsg(msgRaw)
+	msgRaw.requestID = requestID
+	if proto.Priority > msgRaw.priority {
+		msgRaw.priority = proto.Priority
+	}
+	if msgRaw.priority >= numPriorities {
+		msgRaw.priority = PriorityHigh
+	}
+	return msgRaw, nil
+}
+
+// queueMsg queues msgSend to be written by writeLoop and waits for the result
+func (p *Peer) queueMsg(msgSend *msg) error {
+	errc := make(chan error, 1)
+	p.queueMsgAsync(msgSend, func(err error) { errc <- err })
+	return <-errc
+}
+
+// queueMsgAsync queues msgSend to be written by writeLoop, done is called with the result
+func (p *Peer) queueMsgAsync(msgSend *msg, done func(error)) {
+	req := &writeReq{
+		msg:  msgSend,
+		done: done,
+	}
+	if !p.sendQueue.push(req) {
+		done(errPeerDisconnected)
+	}
 }
 
+// sendCtlMsg sends a control message without payload. A stalled write is retried
+// once after a short delay, so transient congestion does not drop a healthy peer.
 func (p *Peer) sendCtlMsg(msgCode uint16) error {
 	hsMsg := &msg{
 		protoCode: ctlProtoCode,
@@ -161,59 +693,165 @@ func (p *Peer) sendCtlMsg(msgCode uint16) error {
 		},
 	}
 	hsMsg.size = 0
-	p.sendRawMsg(hsMsg)
-	return nil
+	err := p.sendRawMsg(hsMsg)
+	if err == errWriteStalled {
+		time.Sleep(ctlWriteRetryDelay)
+		err = p.sendRawMsg(hsMsg)
+	}
+	return err
+}
+
+// sendDiscMsg tells the remote the reason of disconnecting, errors are ignored
+// since the connection will be closed anyway.
+func (p *Peer) sendDiscMsg(reason uint) {
+	payload, err := common.Serialize(reason)
+	if err != nil {
+		return
+	}
+	discMsg := &msg{
+		protoCode: ctlProtoCode,
+		Message: Message{
+			msgCode: ctlMsgDiscCode,
+			size:    uint32(len(payload)),
+			payload: payload,
+		},
+	}
+	p.writeRawMsg(discMsg, discWriteTimeout)
 }
 
 func (p *Peer) sendRawMsg(msgSend *msg) error {
+	return p.writeRawMsg(msgSend, frameWriteTimeout)
+}
+
+func (p *Peer) writeRawMsg(msgSend *msg, timeout time.Duration) error {
 	p.wMutex.Lock()
 	defer p.wMutex.Unlock()
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint32(b[:4], msgSend.size)
-	binary.BigEndian.PutUint16(b[4:6], msgSend.protoCode)
-	binary.BigEndian.PutUint16(b[6:8], msgSend.msgCode)
-	p.conn.SetWriteDeadline(time.Now().Add(frameWriteTimeout))
+	b := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(b[:2], headerMagic)
+	binary.BigEndian.PutUint32(b[2:6], msgSend.size)
+	binary.BigEndian.PutUint16(b[6:8], msgSend.protoCode)
+	binary.BigEndian.PutUint16(b[8:10], msgSend.msgCode)
+	binary.BigEndian.PutUint32(b[10:14], msgSend.requestID)
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
 
-	_, err := p.conn.Write(b)
+	n, err := p.conn.Write(b)
 	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && n == 0 {
+			return errWriteStalled
+		}
 		return err
 	}
-	_, err = p.conn.Write(msgSend.payload)
-	if err != nil {
-		return err
+	if len(msgSend.payload) > 0 {
+		if _, err = p.conn.Write(msgSend.payload); err != nil {
+			return err
+		}
 	}
+	p.metrics.msgSent(msgSend)
 	p.log.Debug("sendRawMsg protoCode:%d msgCode:%d", msgSend.protoCode, msgSend.msgCode)
 	return nil
 }
 
 func (p *Peer) recvRawMsg() (msgRecv *msg, err error) {
-	headbuf := make([]byte, 8)
-	p.conn.SetReadDeadline(time.Now().Add(frameReadTimeout))
-	_, err1 := io.ReadFull(p.conn, headbuf)
+	return p.readRawMsg(frameReadTimeout)
+}
 
-	if err1 != nil {
-		return nil, err1
+// readRawMsg reads a frame which should be received completely within timeout
+func (p *Peer) readRawMsg(timeout time.Duration) (msgRecv *msg, err error) {
+	headbuf := make([]byte, headerSize)
+	deadline := time.Now().Add(timeout)
+	p.conn.SetReadDeadline(deadline)
+	// the magic is checked first, so short probes are rejected without waiting
+	if _, err := io.ReadFull(p.conn, headbuf[:2]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(headbuf[:2]) != headerMagic {
+		return nil, newPeerError(discProtocolError, errHeaderMagic)
+	}
+	if _, err := io.ReadFull(p.conn, headbuf[2:]); err != nil {
+		return nil, err
 	}
 	msgRecv = &msg{
-		protoCode: binary.BigEndian.Uint16(headbuf[4:6]),
+		protoCode: binary.BigEndian.Uint16(headbuf[6:8]),
 		Message: Message{
-			size:    binary.BigEndian.Uint32(headbuf[:4]),
-			msgCode: binary.BigEndian.Uint16(headbuf[6:8]),
+			size:      binary.BigEndian.Uint32(headbuf[2:6]),
+			msgCode:   binary.BigEndian.Uint16(headbuf[8:10]),
+			requestID: binary.BigEndian.Uint32(headbuf[10:14]),
 		},
 	}
 
-	msgRecv.payload = make([]byte, msgRecv.size)
-	if _, err := io.ReadFull(p.conn, msgRecv.payload); err != nil {
-		return nil, err
+	// the size is checked before allocating the payload
+	if msgRecv.protoCode == ctlProtoCode {
+		if err := validateCtlSize(msgRecv.msgCode, msgRecv.size); err != nil {
+			return nil, newPeerError(discProtocolError, err)
+		}
+	}
+	if msgRecv.protoCode != ctlProtoCode {
+		p.capLock.RLock()
+		proto, ok := p.protoMap[msgRecv.protoCode]
+		p.capLock.RUnlock()
+		if !ok {
+			return nil, newPeerError(discProtocolError, fmt.Errorf("not valid protoCode %d", msgRecv.protoCode))
+		}
+		if proto.MaxMsgSize > 0 && msgRecv.size > proto.MaxMsgSize {
+			return nil, newPeerError(discProtocolError, errMsgTooLarge)
+		}
+	}
+
+	// frames without payload, such as ping and pong, are complete with the header
+	if msgRecv.size > 0 {
+		if err := p.readPayload(msgRecv, deadline); err != nil {
+			return nil, err
+		}
 	}
 	msgRecv.ReceivedAt = time.Now()
 	msgRecv.CurPeer = p
+	p.metrics.msgReceived(msgRecv)
 	p.log.Debug("recvRawMsg protoCode:%d msgCode:%d", msgRecv.protoCode, msgRecv.msgCode)
 	return msgRecv, nil
 }
 
+// readPayload reads the payload of msgRecv before deadline
+func (p *Peer) readPayload(msgRecv *msg, deadline time.Time) error {
+	// The payload should arrive at the throughput floor at least, so that
+	// slow-drip senders can not hold the connection while transferring almost nothing.
+	throttled := false
+	if p.minReadThroughput > 0 {
+		payloadDeadline := time.Now().Add(p.readGrace + time.Duration(msgRecv.size)*time.Second/time.Duration(p.minReadThroughput))
+		if payloadDeadline.Before(deadline) {
+			p.conn.SetReadDeadline(payloadDeadline)
+			throttled = true
+		}
+	}
+
+	msgRecv.payload = make([]byte, msgRecv.size)
+	if _, err := io.ReadFull(p.conn, msgRecv.payload); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && throttled {
+			return newPeerError(discSlowRead, errSlowRead)
+		}
+		return err
+	}
+	return nil
+}
+
+func (p *Peer) String() string {
+	if p.node == nil {
+		return fmt.Sprintf("Peer %s", p.conn.RemoteAddr())
+	}
+	return fmt.Sprintf("Peer %s", p.node)
+}
+
+// logFields returns the standard log fields of the peer
+func (p *Peer) logFields() log.Fields {
+	direction := "outbound"
+	if p.inbound {
+		direction = "inbound"
+	}
+	return log.Fields{"peer": p.String(), "direction": direction}
+}
+
 // Disconnect terminates the peer connection with the given reason.
 // It returns immediately and does not wait until the connection is closed.
+// It is safe to call concurrently and after the peer is closed.
 func (p *Peer) Disconnect(reason uint) {
 	select {
 	case p.disc <- reason:
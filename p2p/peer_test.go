@@ -0,0 +1,710 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"encoding/binary"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/log"
+)
+
+func newTestProtocol(name string) *Protocol {
+	return &Protocol{
+		Name:      name,
+		Version:   1,
+		AddPeerCh: make(chan *Peer, 1),
+		DelPeerCh: make(chan *Peer, 1),
+		ReadMsgCh: make(chan *Message, 1),
+	}
+}
+
+// newTestPeerPair creates two peers connected by a pipe, protos are registered at both ends
+func newTestPeerPair(protos ...*Protocol) (*Peer, *Peer) {
+	c1, c2 := net.Pipe()
+	p1 := newPeer(c1, log.GetLogger("p2p", true))
+	p2 := newPeer(c2, log.GetLogger("p2p", true))
+	protoCode := uint16(baseProtoCode)
+	for _, proto := range protos {
+		p1.protoMap[protoCode] = proto
+		p1.capMap[proto.cap().String()] = protoCode
+		// the remote has its own instance of the same protocol
+		p2.protoMap[protoCode] = newTestProtocol(proto.Name)
+		p2.capMap[proto.cap().String()] = protoCode
+		protoCode++
+	}
+
+	return p1, p2
+}
+
+func Test_Message_SerializeError(t *testing.T) {
+	// rlp does not support signed integer
+	m, err := NewMessage(1, int(-1))
+	assert.Equal(t, m == nil, true)
+	assert.Equal(t, err != nil, true)
+}
+
+func Test_Peer_SendMsg(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	go p1.run()
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+
+	m, err := NewMessage(5, "hello")
+	assert.Equal(t, err, nil)
+
+	errc := make(chan error, 1)
+	go func() { errc <- p1.SendMsg(proto, m) }()
+
+	recv, err := p2.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, <-errc, nil)
+	assert.Equal(t, recv.protoCode, uint16(baseProtoCode))
+	assert.Equal(t, recv.Code(), uint16(5))
+
+	var content string
+	assert.Equal(t, recv.Decode(&content), nil)
+	assert.Equal(t, content, "hello")
+}
+
+func Test_Peer_MsgPriority(t *testing.T) {
+	normal, high := newTestProtocol("normal"), newTestProtocol("high")
+	high.Priority = PriorityHigh
+	p1, p2 := newTestPeerPair(normal, high)
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+
+	m, err := NewMessage(1, "block")
+	assert.Equal(t, err, nil)
+	msgRaw, err := p1.newProtoMsg(normal, m, 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgRaw.priority, PriorityNormal)
+
+	// derived from the protocol
+	msgRaw, err = p1.newProtoMsg(high, m, 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgRaw.priority, PriorityHigh)
+
+	// raised by the message
+	msgRaw, err = p1.newProtoMsg(normal, m.SetPriority(PriorityHigh), 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgRaw.priority, PriorityHigh)
+
+	// unknown priorities are treated as high
+	msgRaw, err = p1.newProtoMsg(normal, m.SetPriority(7), 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, msgRaw.priority, PriorityHigh)
+}
+
+func Test_Peer_SendMsgMalformed(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+
+	m := &Message{msgCode: 5, size: 10, payload: []byte{1}}
+	assert.Equal(t, p1.SendMsg(proto, m), errMsgSizeMismatch)
+
+	// nothing should be written to the connection
+	p2.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := p2.conn.Read(make([]byte, 8))
+	netErr, ok := err.(net.Error)
+	assert.Equal(t, ok && netErr.Timeout(), true)
+}
+
+func Test_Peer_RecvMalformedDisc(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	defer p2.conn.Close()
+	go p1.run()
+
+	// disc message with a payload can not be decoded as reason
+	bad := &msg{
+		protoCode: ctlProtoCode,
+		Message:   Message{msgCode: ctlMsgDiscCode, size: 1, payload: []byte{0xff}},
+	}
+	assert.Equal(t, p2.sendRawMsg(bad), nil)
+
+	// p1 should tell us it disconnects for protocol error
+	recv, err := p2.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.protoCode, ctlProtoCode)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(discProtocolError))
+
+	select {
+	case <-p1.closed:
+	case <-time.After(time.Second):
+		t.Fatal("peer is not disconnected")
+	}
+	perr, ok := p1.err.(*peerError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, perr.reason, uint(discProtocolError))
+}
+
+func Test_Peer_RemoteDisc(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	defer p2.conn.Close()
+	go p1.run()
+
+	go p2.sendDiscMsg(discServerQuit)
+
+	select {
+	case <-p1.closed:
+	case <-time.After(time.Second):
+		t.Fatal("peer is not disconnected")
+	}
+	perr, ok := p1.err.(*peerError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, perr.reason, uint(discServerQuit))
+	assert.Equal(t, perr.err, errRemoteDisc)
+}
+
+func Test_Peer_SendMsgCtlProtoCode(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair()
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+
+	// a buggy mapping to the control protoCode must not be used by protocols
+	p1.protoMap[ctlProtoCode] = proto
+	p1.capMap[proto.cap().String()] = ctlProtoCode
+
+	m, _ := NewMessage(ctlMsgPingCode, "ping")
+	assert.Equal(t, p1.SendMsg(proto, m), errCtlProtoCode)
+}
+
+func Test_Peer_SendMsgCodeRange(t *testing.T) {
+	proto := newTestProtocol("test")
+	proto.Length = 2
+	p1, p2 := newTestPeerPair(proto)
+	go p1.run()
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+
+	m, _ := NewMessage(2, "out of range")
+	assert.Equal(t, p1.SendMsg(proto, m), errMsgCodeRange)
+
+	m, _ = NewMessage(1, "in range")
+	errc := make(chan error, 1)
+	go func() { errc <- p1.SendMsg(proto, m) }()
+	recv, err := p2.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, <-errc, nil)
+	assert.Equal(t, recv.Code(), uint16(1))
+}
+
+func Test_Peer_ConcurrentDisconnect(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		p1, p2 := newTestPeerPair()
+		go p1.run()
+
+		var wg sync.WaitGroup
+		for j := 0; j < 20; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p1.Disconnect(discServerQuit)
+			}()
+		}
+		// the remote quits concurrently with Disconnect calls
+		p2.conn.Close()
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Disconnect is blocked after peer quits")
+		}
+		<-p1.closed
+		// Disconnect after the peer quits returns at once
+		p1.Disconnect(discServerQuit)
+	}
+}
+
+func Test_Peer_AnnounceProtocol(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	local, remote := newTestProtocol("new"), newTestProtocol("new")
+	p2.lookupProto = func(cap Cap) *Protocol {
+		if cap == remote.cap() {
+			return remote
+		}
+		return nil
+	}
+	go p1.run()
+	go p2.run()
+	defer p1.Disconnect(discServerQuit)
+
+	assert.Equal(t, p1.announceProtocol(local), nil)
+	assert.Equal(t, <-local.AddPeerCh, p1)
+	select {
+	case p := <-remote.AddPeerCh:
+		assert.Equal(t, p, p2)
+	case <-time.After(time.Second):
+		t.Fatal("remote does not add the announced protocol")
+	}
+
+	m, _ := NewMessage(1, "new protocol")
+	assert.Equal(t, p1.SendMsg(local, m), nil)
+	select {
+	case recv := <-remote.ReadMsgCh:
+		var content string
+		recv.Decode(&content)
+		assert.Equal(t, content, "new protocol")
+	case <-time.After(time.Second):
+		t.Fatal("message of announced protocol is not routed")
+	}
+
+	// announcing again is rejected
+	assert.Equal(t, p1.announceProtocol(local) != nil, true)
+}
+
+func Test_Peer_AnnounceProtocolRejected(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	p2.lookupProto = func(cap Cap) *Protocol { return nil }
+	go p1.run()
+	go p2.run()
+	defer p1.Disconnect(discServerQuit)
+
+	// the remote lacks the protocol, it is not registered
+	local := newTestProtocol("new")
+	assert.Equal(t, p1.announceProtocol(local), errCapRejected)
+	assert.Equal(t, len(p1.Caps()), 0)
+	m, _ := NewMessage(1, "new protocol")
+	assert.Equal(t, p1.SendMsg(local, m), errProtoNotShared)
+
+	// the peer is kept
+	select {
+	case <-p1.closed:
+		t.Fatal("peer is disconnected")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_Peer_AnnounceProtocolConcurrent(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	p2.inbound = true
+	x1, x2 := newTestProtocol("x"), newTestProtocol("x")
+	y1, y2 := newTestProtocol("y"), newTestProtocol("y")
+	p1.lookupProto = func(cap Cap) *Protocol {
+		if cap == y1.cap() {
+			return y1
+		}
+		return nil
+	}
+	p2.lookupProto = func(cap Cap) *Protocol {
+		if cap == x2.cap() {
+			return x2
+		}
+		return nil
+	}
+	go p1.run()
+	go p2.run()
+	defer p1.Disconnect(discServerQuit)
+
+	// both ends announce a protocol at the same time
+	errc := make(chan error, 2)
+	go func() { errc <- p1.announceProtocol(x1) }()
+	go func() { errc <- p2.announceProtocol(y2) }()
+	assert.Equal(t, <-errc, nil)
+	assert.Equal(t, <-errc, nil)
+	for _, ch := range []chan *Peer{x1.AddPeerCh, x2.AddPeerCh, y1.AddPeerCh, y2.AddPeerCh} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("peer does not join the announced protocol")
+		}
+	}
+
+	// the protoCodes differ and are the same at both ends
+	xCode, _ := p1.protoCode(x1)
+	yCode, _ := p1.protoCode(y1)
+	assert.Equal(t, xCode != yCode, true)
+	code, _ := p2.protoCode(x2)
+	assert.Equal(t, code, xCode)
+	code, _ = p2.protoCode(y2)
+	assert.Equal(t, code, yCode)
+
+	// frames are routed to their own protocol
+	m, _ := NewMessage(1, "x")
+	assert.Equal(t, p1.SendMsg(x1, m), nil)
+	select {
+	case recv := <-x2.ReadMsgCh:
+		var content string
+		recv.Decode(&content)
+		assert.Equal(t, content, "x")
+	case <-y2.ReadMsgCh:
+		t.Fatal("frame of x is routed to y")
+	case <-time.After(time.Second):
+		t.Fatal("frame of x is not received")
+	}
+}
+
+func Test_Peer_AddProtocolOnlyAdds(t *testing.T) {
+	p := newPeer(nil, log.GetLogger("p2p", true))
+	old, other := newTestProtocol("old"), newTestProtocol("other")
+	assert.Equal(t, p.addProtocol(old, uint16(baseProtoCode)), true)
+	<-old.AddPeerCh
+
+	// the protoCode is in use, it must not be replaced
+	assert.Equal(t, p.addProtocol(other, uint16(baseProtoCode)), false)
+	assert.Equal(t, p.protoMap[uint16(baseProtoCode)], old)
+	_, ok := p.capMap[other.cap().String()]
+	assert.Equal(t, ok, false)
+}
+
+func Test_Peer_SlowReadDropped(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	p1.minReadThroughput = 100
+	p1.readGrace = 100 * time.Millisecond
+	go p1.run()
+	defer p2.conn.Close()
+
+	// the header announces 100 bytes, which should arrive within 1.1s
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(header[:2], headerMagic)
+	binary.BigEndian.PutUint32(header[2:6], 100)
+	binary.BigEndian.PutUint16(header[6:8], ctlProtoCode)
+	binary.BigEndian.PutUint16(header[8:10], ctlMsgProtoTable)
+	go func() {
+		if _, err := p2.conn.Write(header); err != nil {
+			return
+		}
+		// drip the payload one byte every 100ms
+		for i := 0; i < 100; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if _, err := p2.conn.Write([]byte{0}); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-p1.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("slow-drip peer is not dropped")
+	}
+	perr, ok := p1.err.(*peerError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, perr.reason, uint(discSlowRead))
+}
+
+func Test_Peer_SendMsgOrderPerProtocol(t *testing.T) {
+	protoA, protoB := newTestProtocol("a"), newTestProtocol("b")
+	p1, p2 := newTestPeerPair(protoA, protoB)
+	remoteA, remoteB := p2.protoMap[uint16(baseProtoCode)], p2.protoMap[uint16(baseProtoCode)+1]
+	go p1.run()
+	go p2.run()
+	defer p1.Disconnect(discServerQuit)
+
+	const count = 50
+	// protocol b sends concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				m, _ := NewMessage(1, uint(j))
+				p1.SendMsg(protoB, m)
+			}
+		}()
+	}
+	go func() {
+		for range remoteB.ReadMsgCh {
+		}
+	}()
+	go func() {
+		for i := 0; i < count; i++ {
+			m, _ := NewMessage(1, uint(i))
+			p1.SendMsg(protoA, m)
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		select {
+		case recv := <-remoteA.ReadMsgCh:
+			var seq uint
+			assert.Equal(t, recv.Decode(&seq), nil)
+			assert.Equal(t, seq, uint(i))
+		case <-time.After(3 * time.Second):
+			t.Fatal("message is not received")
+		}
+	}
+	wg.Wait()
+}
+
+func Test_Peer_SendMsgDisconnected(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	go p1.run()
+	p2.conn.Close()
+	<-p1.closed
+
+	m, _ := NewMessage(1, "after disconnected")
+	assert.Equal(t, p1.SendMsg(proto, m), errPeerDisconnected)
+}
+
+func Test_Peer_SendMsgAsync(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	go p1.run()
+	go p2.recvRawMsg()
+
+	done := make(chan error, 1)
+	m, _ := NewMessage(1, "async")
+	p1.SendMsgAsync(proto, m, func(err error) { done <- err })
+	select {
+	case err := <-done:
+		assert.Equal(t, err, nil)
+	case <-time.After(3 * time.Second):
+		t.Fatal("done is not called")
+	}
+
+	p2.conn.Close()
+	<-p1.closed
+	p1.SendMsgAsync(proto, m, func(err error) { done <- err })
+	assert.Equal(t, <-done, errPeerDisconnected)
+}
+
+func Test_Peer_MsgFloodDropped(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	p1.maxMsgRate = 10
+	go p1.run()
+	defer p2.conn.Close()
+	go func() {
+		for range proto.ReadMsgCh {
+		}
+	}()
+
+	go func() {
+		m, _ := NewMessage(1, "flood")
+		msgRaw := &msg{protoCode: uint16(baseProtoCode), Message: *m}
+		for i := 0; i < 100; i++ {
+			if p2.sendRawMsg(msgRaw) != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-p1.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("flooding peer is not dropped")
+	}
+	perr, ok := p1.err.(*peerError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, perr.reason, uint(discMsgFlood))
+}
+
+func Test_Peer_MaxMsgSize(t *testing.T) {
+	small, large := newTestProtocol("small"), newTestProtocol("large")
+	small.MaxMsgSize, large.MaxMsgSize = 16, 1024
+	p1, p2 := newTestPeerPair(small, large)
+	go p1.run()
+	defer p2.conn.Close()
+
+	payload := make([]byte, 64)
+	m := &Message{msgCode: 1, size: uint32(len(payload)), payload: payload}
+	// the limit of local protocol is checked on sending too
+	assert.Equal(t, p1.SendMsg(small, m), errMsgTooLarge)
+
+	// the message is within the limit of large
+	msgRaw := &msg{protoCode: uint16(baseProtoCode) + 1, Message: *m}
+	assert.Equal(t, p2.sendRawMsg(msgRaw), nil)
+	select {
+	case recv := <-large.ReadMsgCh:
+		assert.Equal(t, len(recv.payload), len(payload))
+	case <-time.After(time.Second):
+		t.Fatal("message within limit is not received")
+	}
+
+	// but exceeds the limit of small
+	msgRaw.protoCode = uint16(baseProtoCode)
+	go p2.sendRawMsg(msgRaw)
+	go p2.recvRawMsg() // disc message
+	select {
+	case <-p1.closed:
+	case <-time.After(time.Second):
+		t.Fatal("peer is not disconnected")
+	}
+	perr, ok := p1.err.(*peerError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, perr.reason, uint(discProtocolError))
+	assert.Equal(t, perr.err, errMsgTooLarge)
+}
+
+func Test_Peer_RecvHeaderMagic(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+
+	go p2.conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	_, err := p1.recvRawMsg()
+	perr, ok := err.(*peerError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, perr.err, errHeaderMagic)
+	assert.Equal(t, perr.reason, uint(discProtocolError))
+}
+
+func Test_Peer_RecvZeroPayloadCtlMsg(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	go p1.run()
+	defer p2.conn.Close()
+
+	// ping has no payload, the header alone is answered with pong
+	assert.Equal(t, p2.sendCtlMsg(ctlMsgPingCode), nil)
+	recv, err := p2.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.protoCode, ctlProtoCode)
+	assert.Equal(t, recv.Code(), ctlMsgPongCode)
+	assert.Equal(t, len(recv.payload), 0)
+}
+
+func Test_Peer_RecvCtlMsgSize(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	go p1.run()
+	defer p2.conn.Close()
+
+	// ping with a payload is malformed
+	bad := &msg{
+		protoCode: ctlProtoCode,
+		Message:   Message{msgCode: ctlMsgPingCode, size: 1, payload: []byte{0}},
+	}
+	go p2.sendRawMsg(bad)
+	go p2.recvRawMsg() // disc message
+	select {
+	case <-p1.closed:
+	case <-time.After(time.Second):
+		t.Fatal("peer is not disconnected")
+	}
+	perr, ok := p1.err.(*peerError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, perr.reason, uint(discProtocolError))
+	assert.Equal(t, perr.err, errCtlMsgSize)
+}
+
+func Test_Peer_RecvUnknownFrameSize(t *testing.T) {
+	for _, protoCode := range []uint16{ctlProtoCode, 100} {
+		p1, p2 := newTestPeerPair()
+		defer p2.conn.Close()
+
+		// only the header of a huge frame of unknown code is sent
+		header := make([]byte, headerSize)
+		binary.BigEndian.PutUint16(header[:2], headerMagic)
+		binary.BigEndian.PutUint32(header[2:6], 1<<31)
+		binary.BigEndian.PutUint16(header[6:8], protoCode)
+		binary.BigEndian.PutUint16(header[8:10], 100)
+		go p2.conn.Write(header)
+
+		_, err := p1.recvRawMsg()
+		perr, ok := err.(*peerError)
+		assert.Equal(t, ok, true)
+		assert.Equal(t, perr.reason, uint(discProtocolError))
+		p1.conn.Close()
+	}
+}
+
+func Test_ValidateCtlSize(t *testing.T) {
+	assert.Equal(t, validateCtlSize(ctlMsgPingCode, 0), nil)
+	assert.Equal(t, validateCtlSize(ctlMsgPongCode, 1), errCtlMsgSize)
+	assert.Equal(t, validateCtlSize(ctlMsgProtoHandshake, 0), errCtlMsgSize)
+	assert.Equal(t, validateCtlSize(ctlMsgDiscCode, maxCtlMsgSize), nil)
+	assert.Equal(t, validateCtlSize(ctlMsgProtoTable, maxCtlMsgSize+1), errCtlMsgSize)
+	// unknown control messages carry no payload
+	assert.Equal(t, validateCtlSize(100, 0), nil)
+	assert.Equal(t, validateCtlSize(100, 1), errCtlMsgSize)
+}
+
+func Test_Peer_DisconnectPendingDelivery(t *testing.T) {
+	proto := newTestProtocol("test")
+	// nobody reads messages, the delivery is blocked
+	proto.ReadMsgCh = make(chan *Message)
+	p1, p2 := newTestPeerPair(proto)
+	defer p2.conn.Close()
+	goroutines := runtime.NumGoroutine()
+
+	go p1.run()
+	assert.Equal(t, <-proto.AddPeerCh, p1)
+	m, _ := NewMessage(1, "pending")
+	msgRaw := &msg{protoCode: uint16(baseProtoCode), Message: *m}
+	assert.Equal(t, p2.sendRawMsg(msgRaw), nil)
+	time.Sleep(50 * time.Millisecond)
+
+	p1.Disconnect(discServerQuit)
+	go p2.recvRawMsg() // disc message
+	select {
+	case p := <-proto.DelPeerCh:
+		assert.Equal(t, p, p1)
+	case <-time.After(3 * time.Second):
+		t.Fatal("DelPeerCh is not notified")
+	}
+	select {
+	case <-proto.DelPeerCh:
+		t.Fatal("DelPeerCh is notified twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// all goroutines of the peer quit
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked, %d > %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// stallConn times out the next stalls writes without writing anything
+type stallConn struct {
+	net.Conn
+	stalls int
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	if c.stalls > 0 {
+		c.stalls--
+		return 0, timeoutError{}
+	}
+	return c.Conn.Write(b)
+}
+
+func Test_Peer_SendCtlMsgStalled(t *testing.T) {
+	p1, p2 := newTestPeerPair()
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+
+	// a brief stall is retried
+	p1.conn = &stallConn{Conn: p1.conn, stalls: 1}
+	errc := make(chan error, 1)
+	go func() { errc <- p1.sendCtlMsg(ctlMsgPingCode) }()
+	recv, err := p2.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgPingCode)
+	assert.Equal(t, <-errc, nil)
+
+	// a lasting stall fails
+	p1.conn = &stallConn{Conn: p1.conn, stalls: 2}
+	assert.Equal(t, p1.sendCtlMsg(ctlMsgPingCode), errWriteStalled)
+}
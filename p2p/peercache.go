@@ -0,0 +1,110 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"math"
+	"net"
+	"sync"
+
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+// Maximum number of recently connected peers kept for export.
+const maxPeerCache = 64
+
+// peerRecord is the exported record of a peer, only what is needed to dial it
+type peerRecord struct {
+	ID      common.Address
+	IP      net.IP
+	UDPPort uint16
+	TCPPort uint16
+}
+
+// peerCache keeps the nodes of recently connected good peers, so that they can be
+// exported and dialed at next start before discovery warms up.
+type peerCache struct {
+	lock  sync.Mutex
+	nodes []*discovery.Node // the most recently connected is the last
+}
+
+// add records node as recently connected, the oldest node is evicted if full.
+// Nodes that cannot be dialed, such as inbound peers without advertised port, are skipped.
+func (c *peerCache) add(node *discovery.Node) {
+	if !dialable(node.IP, node.UDPPort, node.TCPPort) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.removeLocked(node.ID)
+	if len(c.nodes) >= maxPeerCache {
+		c.nodes = c.nodes[1:]
+	}
+	c.nodes = append(c.nodes, node)
+}
+
+// remove forgets the node of id, e.g. a peer misbehaved
+func (c *peerCache) remove(id common.Address) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.removeLocked(id)
+}
+
+func (c *peerCache) removeLocked(id common.Address) {
+	for i, node := range c.nodes {
+		if node.ID == id {
+			c.nodes = append(c.nodes[:i:i], c.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// encode serializes the records of the cached nodes
+func (c *peerCache) encode() ([]byte, error) {
+	c.lock.Lock()
+	records := make([]peerRecord, len(c.nodes))
+	for i, node := range c.nodes {
+		records[i] = peerRecord{node.ID, node.IP, uint16(node.UDPPort), uint16(node.TCPPort)}
+	}
+	c.lock.Unlock()
+
+	return common.Serialize(records)
+}
+
+// decodePeerRecords parses the nodes exported by peerCache.encode, records that
+// cannot be dialed are skipped.
+func decodePeerRecords(data []byte) ([]*discovery.Node, error) {
+	var records []peerRecord
+	if err := common.Deserialize(data, &records); err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*discovery.Node, 0, len(records))
+	for _, record := range records {
+		if !dialable(record.IP, int(record.UDPPort), int(record.TCPPort)) {
+			continue
+		}
+		node := discovery.NewNode(record.ID, record.IP, int(record.UDPPort))
+		node.TCPPort = int(record.TCPPort)
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// dialable reports whether a node at ip with the ports can be dialed, the ports
+// must fit in a peer record.
+func dialable(ip net.IP, udpPort, tcpPort int) bool {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len || ip.IsUnspecified() {
+		return false
+	}
+	if udpPort < 0 || udpPort > math.MaxUint16 || tcpPort < 0 || tcpPort > math.MaxUint16 {
+		return false
+	}
+	return udpPort != 0 || tcpPort != 0
+}
@@ -0,0 +1,66 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+func Test_PeerCache_RoundTrip(t *testing.T) {
+	var c peerCache
+	node1, node2 := discovery.NewNode(common.Address{1}, net.ParseIP("127.0.0.1"), 1), discovery.NewNode(common.Address{2}, net.ParseIP("::1"), 2)
+	node2.TCPPort = 3
+	c.add(node1)
+	c.add(node2)
+	c.add(node1)
+
+	data, err := c.encode()
+	assert.Equal(t, err, nil)
+	nodes, err := decodePeerRecords(data)
+	assert.Equal(t, err, nil)
+
+	// the most recently connected is the last
+	assert.Equal(t, len(nodes), 2)
+	assert.Equal(t, nodes[0].ID, node2.ID)
+	assert.Equal(t, nodes[0].IP.String(), "::1")
+	assert.Equal(t, nodes[0].UDPPort, 2)
+	assert.Equal(t, nodes[0].TCPPort, 3)
+	assert.Equal(t, nodes[1].ID, node1.ID)
+	assert.Equal(t, nodes[1].IP.String(), "127.0.0.1")
+
+	c.remove(node2.ID)
+	assert.Equal(t, len(c.nodes), 1)
+
+	// inbound peers without advertised port and of unknown IP cannot be dialed
+	c.add(discovery.NewNode(common.Address{3}, net.ParseIP("127.0.0.1"), 0))
+	c.add(discovery.NewNode(common.Address{4}, nil, 1))
+	assert.Equal(t, len(c.nodes), 1)
+}
+
+func Test_PeerCache_Corrupted(t *testing.T) {
+	_, err := decodePeerRecords([]byte{0xff, 0x01})
+	assert.Equal(t, err != nil, true)
+
+	// records with invalid IP or without port are skipped
+	data, _ := common.Serialize([]peerRecord{
+		{ID: common.Address{1}, IP: []byte{1, 2, 3}, UDPPort: 1},
+		{ID: common.Address{2}, IP: net.ParseIP("127.0.0.1")},
+		{ID: common.Address{3}, IP: net.ParseIP("127.0.0.1"), TCPPort: 1},
+	})
+	nodes, err := decodePeerRecords(data)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(nodes), 1)
+	assert.Equal(t, nodes[0].ID, common.Address{3})
+
+	srv := newTestServer(t)
+	assert.Equal(t, srv.ImportPeers([]byte("not peers")) != nil, true)
+	assert.Equal(t, len(srv.imported), 0)
+}
@@ -22,6 +22,19 @@ type Protocol struct {
 
 	// Version should contain the version number of the protocol.
 	Version uint
+
+	// Length is the number of message codes used by the protocol, msgCode should be
+	// less than it. Zero means the protocol does not declare its capacity.
+	Length uint16
+
+	// MaxMsgSize is the maximum payload size of messages of the protocol, peers
+	// sending larger ones are disconnected. Zero means no limit.
+	MaxMsgSize uint32
+
+	// Priority is the send priority of all messages of the protocol, individual
+	// messages can be raised by Message.SetPriority. Zero is PriorityNormal.
+	Priority Priority
+
 	// AddPeerCh a peer joins protocol, SubProtocol should handle the channel
 	AddPeerCh chan *Peer
 
@@ -30,6 +43,9 @@ type Protocol struct {
 
 	// ReadMsgCh a whole Message has recved, SubProtocol can handle as quickly as possible
 	ReadMsgCh chan *Message
+
+	// done is closed when Run of the protocol quits, peers stop sending to it then
+	done chan struct{}
 }
 
 // ProtocolInterface high level protocol should implement this interface
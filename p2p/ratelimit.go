@@ -0,0 +1,42 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"time"
+)
+
+// rateLimiter is a token bucket allowing rate events per second on average,
+// with bursts of up to rate events. It is not safe for concurrent use.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+// allow takes a token at now, it returns false if there is none left
+func (l *rateLimiter) allow(now time.Time) bool {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+		l.last = now
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
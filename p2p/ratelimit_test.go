@@ -0,0 +1,35 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(10, now)
+
+	// a burst of rate events is allowed
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, l.allow(now), true)
+	}
+	assert.Equal(t, l.allow(now), false)
+
+	// tokens are refilled at rate
+	assert.Equal(t, l.allow(now.Add(100*time.Millisecond)), true)
+	assert.Equal(t, l.allow(now.Add(100*time.Millisecond)), false)
+
+	// but no more than a burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, l.allow(later), true)
+	}
+	assert.Equal(t, l.allow(later), false)
+}
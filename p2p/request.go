@@ -0,0 +1,102 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// responseFlag is set in the requestID of a response frame
+const responseFlag uint32 = 1 << 31
+
+var (
+	errNotRequest       = errors.New("message is not a request")
+	errUnknownRequest   = errors.New("unknown request id")
+	errRequestTimeout   = errors.New("request timeout")
+	errPeerDisconnected = errors.New("peer disconnected")
+)
+
+// RequestID returns the request id of the message, zero if it is not a request
+func (m *Message) RequestID() uint32 {
+	return m.requestID &^ responseFlag
+}
+
+// SendRequest sends msgSend as a request of proto. A request id is stamped into the
+// frame and returned, the response is awaited by WaitResponse.
+func (p *Peer) SendRequest(proto *Protocol, msgSend *Message) (uint32, error) {
+	var requestID uint32
+	for requestID == 0 {
+		requestID = atomic.AddUint32(&p.lastRequestID, 1) &^ responseFlag
+	}
+
+	p.pendingLock.Lock()
+	p.pending[requestID] = make(chan *Message, 1)
+	p.pendingLock.Unlock()
+
+	if err := p.sendProtoMsg(proto, msgSend, requestID); err != nil {
+		p.removePending(requestID)
+		return 0, err
+	}
+	return requestID, nil
+}
+
+// SendResponse sends msgSend as the response of request, which is received from
+// ReadMsgCh of proto.
+func (p *Peer) SendResponse(proto *Protocol, request *Message, msgSend *Message) error {
+	if request.RequestID() == 0 {
+		return errNotRequest
+	}
+	return p.sendProtoMsg(proto, msgSend, request.RequestID()|responseFlag)
+}
+
+// WaitResponse waits for the response of requestID. It returns errRequestTimeout
+// if no response is received in timeout.
+func (p *Peer) WaitResponse(requestID uint32, timeout time.Duration) (*Message, error) {
+	p.pendingLock.Lock()
+	ch, ok := p.pending[requestID]
+	p.pendingLock.Unlock()
+	if !ok {
+		return nil, errUnknownRequest
+	}
+	defer p.removePending(requestID)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-timer.C:
+		return nil, errRequestTimeout
+	case <-p.closed:
+		return nil, errPeerDisconnected
+	}
+}
+
+// deliverResponse passes the response to its waiter, responses of unknown or
+// timed out requests are dropped.
+func (p *Peer) deliverResponse(resp *Message) {
+	p.pendingLock.Lock()
+	ch, ok := p.pending[resp.RequestID()]
+	p.pendingLock.Unlock()
+	if !ok {
+		p.log.Debug("drop response of unknown request %d", resp.RequestID())
+		return
+	}
+
+	select {
+	case ch <- resp:
+	default:
+	}
+}
+
+func (p *Peer) removePending(requestID uint32) {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+
+	delete(p.pending, requestID)
+}
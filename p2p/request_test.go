@@ -0,0 +1,101 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func Test_Request_Response(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	go p1.run()
+	go p2.run()
+	defer p1.Disconnect(discServerQuit)
+	remote := p2.protoMap[uint16(baseProtoCode)]
+
+	req, _ := NewMessage(1, "ping")
+	id, err := p1.SendRequest(proto, req)
+	assert.Equal(t, err, nil)
+
+	recv := <-remote.ReadMsgCh
+	assert.Equal(t, recv.RequestID(), id)
+	resp, _ := NewMessage(2, "pong")
+	assert.Equal(t, p2.SendResponse(remote, recv, resp), nil)
+
+	got, err := p1.WaitResponse(id, time.Second)
+	assert.Equal(t, err, nil)
+	var content string
+	assert.Equal(t, got.Decode(&content), nil)
+	assert.Equal(t, content, "pong")
+	assert.Equal(t, got.Code(), uint16(2))
+}
+
+func Test_Request_Timeout(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	go p1.run()
+	go p2.run()
+	defer p1.Disconnect(discServerQuit)
+
+	req, _ := NewMessage(1, "ping")
+	id, err := p1.SendRequest(proto, req)
+	assert.Equal(t, err, nil)
+
+	_, err = p1.WaitResponse(id, 50*time.Millisecond)
+	assert.Equal(t, err, errRequestTimeout)
+	_, err = p1.WaitResponse(id, 50*time.Millisecond)
+	assert.Equal(t, err, errUnknownRequest)
+}
+
+func Test_Request_OutOfOrder(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	go p1.run()
+	go p2.run()
+	defer p1.Disconnect(discServerQuit)
+	remote := p2.protoMap[uint16(baseProtoCode)]
+
+	req1, _ := NewMessage(1, "first")
+	id1, err := p1.SendRequest(proto, req1)
+	assert.Equal(t, err, nil)
+	recv1 := <-remote.ReadMsgCh
+
+	req2, _ := NewMessage(1, "second")
+	id2, err := p1.SendRequest(proto, req2)
+	assert.Equal(t, err, nil)
+	recv2 := <-remote.ReadMsgCh
+
+	// respond the second request first
+	resp2, _ := NewMessage(2, "second")
+	assert.Equal(t, p2.SendResponse(remote, recv2, resp2), nil)
+	resp1, _ := NewMessage(2, "first")
+	assert.Equal(t, p2.SendResponse(remote, recv1, resp1), nil)
+
+	var content string
+	got1, err := p1.WaitResponse(id1, time.Second)
+	assert.Equal(t, err, nil)
+	got1.Decode(&content)
+	assert.Equal(t, content, "first")
+
+	got2, err := p1.WaitResponse(id2, time.Second)
+	assert.Equal(t, err, nil)
+	got2.Decode(&content)
+	assert.Equal(t, content, "second")
+}
+
+func Test_Request_NotRequest(t *testing.T) {
+	proto := newTestProtocol("test")
+	p1, p2 := newTestPeerPair(proto)
+	defer p1.conn.Close()
+	defer p2.conn.Close()
+
+	m, _ := NewMessage(1, "not request")
+	assert.Equal(t, p1.SendResponse(proto, m, m), errNotRequest)
+}
@@ -0,0 +1,116 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"sync"
+)
+
+// writeReq is a frame waiting to be written, done is called with the write result
+type writeReq struct {
+	msg  *msg
+	done func(error)
+}
+
+// maxHighBurst is the number of high priority frames written in a row while normal
+// ones are waiting, after which a normal frame is written so it is not starved.
+const maxHighBurst = 8
+
+// sendQueue holds the frames waiting to be written to a peer. High priority frames
+// are written before normal ones. Frames of the same protoCode and priority are
+// written in submission order, while frames of different protoCodes are interleaved
+// round robin so that one protocol can not hold up others.
+type sendQueue struct {
+	lock      sync.Mutex
+	classes   [numPriorities]protoQueues // frames by priority
+	highBurst int                        // high priority frames popped in a row
+	closed    bool
+	wake      chan struct{} // signaled when a frame is pushed
+}
+
+// protoQueues holds the frames of one priority by protoCode
+type protoQueues struct {
+	queues map[uint16][]*writeReq // protoCode => frames in submission order
+	order  []uint16               // protoCodes having frames, in round robin order
+}
+
+func newSendQueue() *sendQueue {
+	q := &sendQueue{
+		wake: make(chan struct{}, 1),
+	}
+	for i := range q.classes {
+		q.classes[i].queues = make(map[uint16][]*writeReq)
+	}
+	return q
+}
+
+// push queues req, it returns false if the queue is closed
+func (q *sendQueue) push(req *writeReq) bool {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return false
+	}
+	q.classes[req.msg.priority].push(req)
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop returns the next frame to write, nil if the queue is empty
+func (q *sendQueue) pop() *writeReq {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	high, normal := &q.classes[PriorityHigh], &q.classes[PriorityNormal]
+	if len(high.order) > 0 && (q.highBurst < maxHighBurst || len(normal.order) == 0) {
+		q.highBurst++
+		return high.pop()
+	}
+	q.highBurst = 0
+	return normal.pop()
+}
+
+// close rejects further pushes and returns the frames not written yet
+func (q *sendQueue) close() []*writeReq {
+	q.lock.Lock()
+	q.closed = true
+	q.lock.Unlock()
+
+	var reqs []*writeReq
+	for req := q.pop(); req != nil; req = q.pop() {
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+func (pq *protoQueues) push(req *writeReq) {
+	code := req.msg.protoCode
+	if len(pq.queues[code]) == 0 {
+		pq.order = append(pq.order, code)
+	}
+	pq.queues[code] = append(pq.queues[code], req)
+}
+
+func (pq *protoQueues) pop() *writeReq {
+	if len(pq.order) == 0 {
+		return nil
+	}
+	code := pq.order[0]
+	pq.order = pq.order[1:]
+	reqs := pq.queues[code]
+	if len(reqs) == 1 {
+		delete(pq.queues, code)
+	} else {
+		pq.queues[code] = reqs[1:]
+		pq.order = append(pq.order, code)
+	}
+	return reqs[0]
+}
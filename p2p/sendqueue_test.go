@@ -0,0 +1,76 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"testing"
+
+	"github.com/magiconair/properties/assert"
+)
+
+func newTestWriteReq(protoCode uint16, msgCode uint16) *writeReq {
+	return &writeReq{
+		msg:  &msg{protoCode: protoCode, Message: Message{msgCode: msgCode}},
+		done: func(error) {},
+	}
+}
+
+func Test_SendQueue_Order(t *testing.T) {
+	q := newSendQueue()
+	q.push(newTestWriteReq(8, 1))
+	q.push(newTestWriteReq(8, 2))
+	q.push(newTestWriteReq(8, 3))
+	q.push(newTestWriteReq(9, 1))
+
+	// frames of a protoCode keep the order, protoCodes are interleaved
+	var got [][2]uint16
+	for req := q.pop(); req != nil; req = q.pop() {
+		got = append(got, [2]uint16{req.msg.protoCode, req.msg.msgCode})
+	}
+	assert.Equal(t, got, [][2]uint16{{8, 1}, {9, 1}, {8, 2}, {8, 3}})
+}
+
+func Test_SendQueue_Close(t *testing.T) {
+	q := newSendQueue()
+	q.push(newTestWriteReq(8, 1))
+
+	assert.Equal(t, len(q.close()), 1)
+	assert.Equal(t, q.push(newTestWriteReq(8, 2)), false)
+	assert.Equal(t, q.pop() == nil, true)
+}
+
+func Test_SendQueue_Priority(t *testing.T) {
+	q := newSendQueue()
+	large := newTestWriteReq(8, 1)
+	large.msg.payload = make([]byte, 1024*1024)
+	large.msg.size = uint32(len(large.msg.payload))
+	q.push(large)
+	small := newTestWriteReq(9, 2)
+	small.msg.priority = PriorityHigh
+	q.push(small)
+
+	// the high priority frame is written first though queued later
+	assert.Equal(t, q.pop(), small)
+	assert.Equal(t, q.pop(), large)
+	assert.Equal(t, q.pop() == nil, true)
+}
+
+func Test_SendQueue_PriorityNoStarvation(t *testing.T) {
+	q := newSendQueue()
+	q.push(newTestWriteReq(8, 0))
+	for i := 1; i <= 2*maxHighBurst; i++ {
+		req := newTestWriteReq(9, uint16(i))
+		req.msg.priority = PriorityHigh
+		q.push(req)
+	}
+
+	// the normal frame is written after a burst of high priority ones
+	for i := 1; i <= maxHighBurst; i++ {
+		assert.Equal(t, q.pop().msg.msgCode, uint16(i))
+	}
+	assert.Equal(t, q.pop().msg.protoCode, uint16(8))
+	assert.Equal(t, q.pop().msg.msgCode, uint16(maxHighBurst+1))
+}
@@ -9,11 +9,17 @@ import (
 	//"crypto/ecdsa"
 
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aristanetworks/goarista/monotime"
@@ -29,6 +35,27 @@ const (
 
 	defaultDialTimeout = 15 * time.Second
 
+	// Default maximum number of caps accepted in a handshake.
+	defaultMaxHandshakeCaps = 32
+
+	// Default maximum time allowed for sending and receiving the handshake.
+	defaultHandshakeTimeout = 5 * time.Second
+
+	// Default fraction of MaxPeers reserved for outbound peers.
+	defaultOutboundReserve = 0.3
+
+	// Default idle time before TCP keepalive probes are sent, and the interval of probes.
+	defaultTCPKeepAlivePeriod = 15 * time.Second
+
+	// Default time the server can have no peers before it is unhealthy.
+	defaultHealthGracePeriod = 5 * time.Minute
+
+	// Default maximum time Stop waits for goroutines of the server to quit.
+	defaultShutdownTimeout = 10 * time.Second
+
+	// Number of errors buffered for Errors, further errors are dropped.
+	errorsBuffer = 16
+
 	// Maximum time allowed for reading a complete message.
 	frameReadTimeout = 30 * time.Second
 
@@ -37,6 +64,20 @@ const (
 
 	inboundConn  = 1
 	outboundConn = 2
+
+	// Prefix of addresses of unix domain sockets, such as "unix:/tmp/seele.sock".
+	unixAddrPrefix = "unix:"
+)
+
+var (
+	// ErrServerNotRunning is returned by methods of Server called before Start or after Stop.
+	ErrServerNotRunning = errors.New("p2p server not running")
+
+	// ErrShutdownTimeout is returned by Stop if goroutines of the server do not quit
+	// within ShutdownTimeout. Connections are closed by force then.
+	ErrShutdownTimeout = errors.New("p2p server shutdown timeout")
+
+	errNoSharedCaps = errors.New("no protocol shared with peer")
 )
 
 // Config holds Server options.
@@ -49,17 +90,132 @@ type Config struct {
 	// Zero defaults to preset values.
 	MaxPendingPeers int `toml:",omitempty"`
 
+	// AcceptConcurrency is the number of goroutines accepting connections of each
+	// listener, so that bursts of inbound connections are taken from the OS backlog
+	// quickly. Accepted connections of all listeners still share the MaxPendingPeers
+	// handshake slots, accepting waits when all slots are taken. Zero defaults to 1.
+	AcceptConcurrency int `toml:",omitempty"`
+
 	MyNodeID string
 	// pre-configured nodes.
 	StaticNodes []*discovery.Node
 
+	// BootstrapNodes are dialed once at Start to kick off discovery on a fresh node.
+	// Unlike StaticNodes they are not kept in the discovery database or redialed.
+	BootstrapNodes []*discovery.Node `toml:",omitempty"`
+
 	KadPort string // udp port for Kad network
 
+	// NetworkID isolates networks, such as testnet and mainnet. Nodes of different
+	// networks do not discover each other and are rejected at handshake.
+	NetworkID uint32 `toml:",omitempty"`
+
 	// Protocols should contain the protocols supported by the server.
 	Protocols []ProtocolInterface `toml:"-"`
 
-	// p2p.server will listen for incoming tcp connections.
+	// p2p.server will listen for incoming tcp connections. A "unix:/path" address
+	// listens on a unix domain socket instead, for local testing and co-located processes.
 	ListenAddr string
+
+	// HandshakeTimeout is the maximum time allowed for each of sending and receiving
+	// the handshake, so that a stalled remote does not hold a handshake slot long.
+	// Zero defaults to preset value.
+	HandshakeTimeout time.Duration `toml:",omitempty"`
+
+	// MaxHandshakeCaps is the maximum number of caps accepted in a remote handshake,
+	// handshakes advertising more caps are rejected. Zero defaults to preset value.
+	MaxHandshakeCaps int `toml:",omitempty"`
+
+	// HandshakeValidator is called with the decoded remote handshake before the peer
+	// is accepted, a non-nil error rejects the peer. It is optional.
+	HandshakeValidator func(caps []Cap, nodeID common.Address) error `toml:"-"`
+
+	// HandshakeRejectReason is the disconnect reason sent to peers rejected by
+	// HandshakeValidator. Zero defaults to discHandshakeReject.
+	HandshakeRejectReason uint `toml:",omitempty"`
+
+	// ConnectionGater allows or denies connections before dialing, on accepting and
+	// after handshake. It is optional, nil allows all connections.
+	ConnectionGater ConnectionGater `toml:"-"`
+
+	// DialJitter is the maximum random delay added before each dial and to the time
+	// a node can be redialed, spreading reconnections over time. Zero defaults to
+	// preset value, negative disables jitter.
+	DialJitter time.Duration `toml:",omitempty"`
+
+	// TCPNagle enables Nagle's algorithm to coalesce small frames on bulk-transfer
+	// nodes. By default TCP_NODELAY is set for latency-sensitive gossip.
+	TCPNagle bool `toml:",omitempty"`
+
+	// TCPReadBuffer and TCPWriteBuffer are the socket buffer sizes of connections.
+	// Zero keeps the OS default.
+	TCPReadBuffer  int `toml:",omitempty"`
+	TCPWriteBuffer int `toml:",omitempty"`
+
+	// TCPKeepAlivePeriod is the period of OS keepalive probes on connections, which
+	// detect dead routes of half-open connections complementary to the ping of peers.
+	// Zero defaults to preset value, negative disables keepalive.
+	TCPKeepAlivePeriod time.Duration `toml:",omitempty"`
+
+	// ListenAddrs are additional addresses to listen on, such as "[::]:port"
+	// beside an IPv4 ListenAddr for dual-stack listening.
+	ListenAddrs []string `toml:",omitempty"`
+
+	// AdvertisedIP is the external IP of self returned by LocalNode, such as the
+	// public address of a NAT gateway. Nil defaults to the host of ListenAddr if
+	// it is a specific address.
+	AdvertisedIP net.IP `toml:",omitempty"`
+
+	// MinReadThroughput is the minimum throughput in bytes per second of frame payload
+	// reads, peers sending slower are disconnected. Zero defaults to preset value,
+	// negative disables it.
+	MinReadThroughput int `toml:",omitempty"`
+
+	// MaxMsgRate is the maximum number of protocol frames per second received from
+	// a peer, peers sending faster are disconnected. Control frames have a separate
+	// allowance. Zero defaults to preset value, negative disables it.
+	MaxMsgRate int `toml:",omitempty"`
+
+	// Dialer creates all outbound connections, so that they can be routed through
+	// a proxy. Nil defaults to the dialer of Transport.
+	Dialer Dialer `toml:"-"`
+
+	// Transport creates the listeners and outbound connections, such as an in-memory
+	// one for tests. Nil defaults to real sockets.
+	Transport Transport `toml:"-"`
+
+	// MaxPeers is the maximum number of connected peers. Zero means no limit.
+	MaxPeers int `toml:",omitempty"`
+
+	// OutboundReserve is the fraction of MaxPeers reserved for outbound peers, which
+	// inbound peers can not take, so that some peers are always chosen by self.
+	// Zero defaults to preset value, negative disables the reservation.
+	OutboundReserve float64 `toml:",omitempty"`
+
+	// NodeAddrs overrides the dial addresses of nodes, such as "unix:/path" for
+	// co-located processes. Nodes not listed are dialed by IP and port.
+	NodeAddrs map[common.Address]string `toml:"-"`
+
+	// Logger receives the logs of the server and its peers, such as one created by
+	// log.NewLogger to set the level. Nil defaults to the "p2p" console logger.
+	Logger *log.SeeleLog `toml:"-"`
+
+	// HealthGracePeriod is the time the server can have no peers before Healthy
+	// reports it unhealthy. Zero defaults to preset value.
+	HealthGracePeriod time.Duration `toml:",omitempty"`
+
+	// ShutdownTimeout is the maximum time Stop waits for connections to close and
+	// goroutines to quit before closing connections by force. Zero defaults to preset value.
+	ShutdownTimeout time.Duration `toml:",omitempty"`
+}
+
+type peerOpFunc func(map[common.Address]*Peer)
+
+// addPeerReq asks the run loop to add a handshaked peer, result receives zero if
+// the peer is added or the reason it is rejected for.
+type addPeerReq struct {
+	peer   *Peer
+	result chan uint
 }
 
 // Server manages all p2p peer connections.
@@ -67,65 +223,430 @@ type Server struct {
 	// Config fields may not be modified while the server is running.
 	Config
 
-	lock    sync.Mutex // protects running
-	running bool
+	lock    sync.Mutex // serializes Start and Stop, protects imported
+	running int32      // set to 1 while running, accessed atomically so Stop does not block protocols
+
+	discovery *discovery.Service
+	kadDB     *discovery.Database
+	listeners []net.Listener
+
+	quit    chan struct{}
+	runDone chan struct{} // closed when run returns, peers stop sending delpeer then
 
-	kadDB    *discovery.Database
-	listener net.Listener
+	addpeer    chan addPeerReq
+	delpeer    chan *Peer
+	peerOp     chan peerOpFunc
+	peerOpDone chan struct{}
+	loopWG     sync.WaitGroup // loop, listenLoop
 
-	quit chan struct{}
+	conns     map[net.Conn]struct{} // connections in handshake or of peers
+	connsLock sync.Mutex            // for conns
 
-	addpeer chan *Peer
-	delpeer chan *Peer
-	loopWG  sync.WaitGroup // loop, listenLoop
+	protoLock sync.RWMutex // protects Protocols, which can be added after Start
 
-	peers map[common.Address]*Peer
-	log   *log.SeeleLog
+	errors chan error // errors of protocols, see Errors
+
+	peers        map[common.Address]*Peer
+	inboundPeers int32 // number of inbound peers, accessed atomically
+	noPeersSince int64 // unix nano since when there is no peer, zero if any. accessed atomically
+	listenerDown int32 // set to 1 if a listener fails, accessed atomically
+	paused       int32 // set to 1 if new peers are not accepted or dialed, accessed atomically
+	dialHistory  *dialHistory
+	reconnect    *reconnectPolicy  // redial of nodes by their last disconnect reason
+	quality      *nodeQuality      // quality scores of nodes, kept across restarts
+	nonces       *nonceHistory     // handshake nonces seen recently
+	peerCache    peerCache         // recently connected good peers, see ExportPeers
+	imported     []*discovery.Node // nodes imported by ImportPeers, dialed at next Start only
+	metrics      *serverMetrics
+	log          *log.SeeleLog
 }
 
 // Start starts running the server.
 func (srv *Server) Start() (err error) {
 	srv.lock.Lock()
 	defer srv.lock.Unlock()
-	if srv.running {
+	if srv.isRunning() {
 		return errors.New("server already running")
 	}
-	srv.log = log.GetLogger("p2p", true)
+	srv.log = srv.Logger
+	if srv.log == nil {
+		srv.log = log.GetLogger("p2p", true)
+	}
 	if srv.log == nil {
 		return errors.New("p2p Create logger error")
 	}
-	srv.running = true
 	srv.peers = make(map[common.Address]*Peer)
+	srv.dialHistory = newDialHistory()
+	srv.reconnect = newReconnectPolicy(srv.dialHistory)
+	srv.nonces = newNonceHistory()
+	if srv.quality == nil {
+		srv.quality = newNodeQuality()
+	}
+	srv.metrics = newServerMetrics()
+	srv.metrics.publish(srv.Name, srv.MyNodeID)
+	srv.conns = make(map[net.Conn]struct{})
+	atomic.StoreInt64(&srv.noPeersSince, time.Now().UnixNano())
+	atomic.StoreInt32(&srv.listenerDown, 0)
 
 	srv.log.Info("Starting P2P networking...")
 	srv.quit = make(chan struct{})
-	srv.addpeer = make(chan *Peer)
+	srv.runDone = make(chan struct{})
+	srv.addpeer = make(chan addPeerReq)
 	srv.delpeer = make(chan *Peer)
+	srv.peerOp = make(chan peerOpFunc)
+	srv.peerOpDone = make(chan struct{})
+	srv.errors = make(chan error, errorsBuffer)
 
-	srv.kadDB = discovery.StartServerFat(srv.KadPort, srv.MyNodeID, srv.StaticNodes)
+	if srv.discovery, err = discovery.StartServerFat(srv.KadPort, srv.MyNodeID, srv.NetworkID, srv.StaticNodes); err != nil {
+		return err
+	}
+	srv.kadDB = srv.discovery.Database()
 	if err := srv.startListening(); err != nil {
+		srv.discovery.Stop()
 		return err
 	}
+	if tcpAddr, ok := srv.listeners[0].Addr().(*net.TCPAddr); ok {
+		_, udpPort := srv.discovery.AdvertisedPorts()
+		srv.discovery.SetAdvertisedPorts(tcpAddr.Port, udpPort)
+	}
 
 	for _, proto := range srv.Protocols {
-		go func() {
-			srv.loopWG.Add(1)
-			proto.Run()
-			close(proto.GetBaseProtocol().AddPeerCh)
-			close(proto.GetBaseProtocol().DelPeerCh)
-			close(proto.GetBaseProtocol().ReadMsgCh)
-			srv.loopWG.Done()
-		}()
+		srv.launchProtocol(proto)
 	}
+	srv.bootstrap()
 	srv.loopWG.Add(1)
 	go srv.run()
-	srv.running = true
+	atomic.StoreInt32(&srv.running, 1)
 
 	return nil
 }
 
+// launchProtocol runs proto unless its Run is still running from a former Start.
+// Protocols have no quit signal, so a restarted server keeps the running ones.
+func (srv *Server) launchProtocol(proto ProtocolInterface) {
+	base := proto.GetBaseProtocol()
+	if base.done != nil {
+		select {
+		case <-base.done:
+		default:
+			return
+		}
+	}
+	base.done = make(chan struct{})
+	go srv.runProtocol(proto, base.done)
+}
+
+// runProtocol runs proto until it quits. Protocols have no quit signal,
+// so Stop does not wait for them. A panic in proto is recovered and reported
+// by Errors, the server keeps running. Once proto quits, done is closed and
+// peers skip it instead of sending on its channels, which are not closed as
+// peers may send on them.
+func (srv *Server) runProtocol(proto ProtocolInterface, done chan struct{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("protocol %s panic, %v", proto.GetBaseProtocol().cap(), r)
+			srv.log.Error("%s\n%s", err, debug.Stack())
+			srv.reportError(err)
+		}
+		close(done)
+	}()
+	proto.Run()
+}
+
+// Errors returns the channel of errors of protocols, such as a panic in Run, so
+// that the application can decide to stop or continue. Errors are dropped if the
+// channel is full. It returns nil before Start.
+func (srv *Server) Errors() <-chan error {
+	return srv.errors
+}
+
+func (srv *Server) reportError(err error) {
+	select {
+	case srv.errors <- err:
+	default:
+	}
+}
+
+// AddProtocol enables proto after Start. It is announced to all connected peers,
+// which can then route messages of proto if they support it too.
+func (srv *Server) AddProtocol(proto ProtocolInterface) error {
+	if !srv.isRunning() {
+		return ErrServerNotRunning
+	}
+
+	cap := proto.GetBaseProtocol().cap()
+	srv.protoLock.Lock()
+	for _, p := range srv.Protocols {
+		if p.GetBaseProtocol().cap() == cap {
+			srv.protoLock.Unlock()
+			return fmt.Errorf("protocol %s already added", cap)
+		}
+	}
+	srv.launchProtocol(proto)
+	srv.Protocols = append(srv.Protocols, proto)
+	srv.protoLock.Unlock()
+
+	srv.doPeerOp(func(peers map[common.Address]*Peer) {
+		for _, p := range peers {
+			go func(p *Peer) {
+				if err := p.announceProtocol(proto.GetBaseProtocol()); err != nil {
+					p.log.Info("announce protocol %s failed, %s", cap, err)
+				}
+			}(p)
+		}
+	})
+	return nil
+}
+
+// protocols returns a snapshot of the protocols of the server
+func (srv *Server) protocols() []ProtocolInterface {
+	srv.protoLock.RLock()
+	defer srv.protoLock.RUnlock()
+
+	return append([]ProtocolInterface(nil), srv.Protocols...)
+}
+
+// findProtocol returns the local protocol of cap, nil if not found
+func (srv *Server) findProtocol(cap Cap) *Protocol {
+	for _, proto := range srv.protocols() {
+		if proto.GetBaseProtocol().cap() == cap {
+			return proto.GetBaseProtocol()
+		}
+	}
+	return nil
+}
+
+// Metrics returns a snapshot of the server metrics, nil before Start.
+func (srv *Server) Metrics() *Metrics {
+	if srv.metrics == nil {
+		return nil
+	}
+	return srv.metrics.snapshot()
+}
+
+// Broadcast sends msg to all connected peers supporting proto concurrently. It
+// returns the errors of failed peers, a failure does not stop sending to others.
+func (srv *Server) Broadcast(proto *Protocol, msg *Message) []error {
+	if !srv.isRunning() {
+		return []error{ErrServerNotRunning}
+	}
+	return srv.BroadcastExcept(proto, msg)
+}
+
+// BroadcastExcept is Broadcast excluding the peers of the given node IDs, e.g.
+// the source peer of a gossip message, which is msg.CurPeer when received.
+func (srv *Server) BroadcastExcept(proto *Protocol, msg *Message, excludes ...common.Address) []error {
+	if !srv.isRunning() {
+		return []error{ErrServerNotRunning}
+	}
+	excluded := make(map[common.Address]bool)
+	for _, id := range excludes {
+		excluded[id] = true
+	}
+	var peers []*Peer
+	srv.doPeerOp(func(peerMap map[common.Address]*Peer) {
+		for id, p := range peerMap {
+			if !excluded[id] {
+				peers = append(peers, p)
+			}
+		}
+	})
+
+	var (
+		errs     []error
+		errsLock sync.Mutex
+		wg       sync.WaitGroup
+	)
+	for _, p := range peers {
+		if _, ok := p.protoCode(proto); !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(p *Peer) {
+			defer wg.Done()
+			if err := p.SendMsg(proto, msg); err != nil {
+				errsLock.Lock()
+				errs = append(errs, fmt.Errorf("send to %s failed, %s", p, err))
+				errsLock.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return errs
+}
+
+// doPeerOp runs op with the peers in the run loop, it returns false if the
+// server is stopped.
+func (srv *Server) doPeerOp(op peerOpFunc) bool {
+	select {
+	case srv.peerOp <- op:
+		<-srv.peerOpDone
+		return true
+	case <-srv.quit:
+		return false
+	}
+}
+
+// Healthy returns whether the server is healthy, or false with the reason if it is
+// not running, a listener is down, or there is no peer for longer than HealthGracePeriod.
+func (srv *Server) Healthy() (bool, string) {
+	if !srv.isRunning() {
+		return false, ErrServerNotRunning.Error()
+	}
+	if atomic.LoadInt32(&srv.listenerDown) != 0 {
+		return false, "listener down"
+	}
+
+	grace := defaultHealthGracePeriod
+	if srv.HealthGracePeriod > 0 {
+		grace = srv.HealthGracePeriod
+	}
+	if since := atomic.LoadInt64(&srv.noPeersSince); since != 0 {
+		if d := time.Since(time.Unix(0, since)); d > grace {
+			return false, fmt.Sprintf("no peers for %s", d)
+		}
+	}
+	return true, ""
+}
+
+// Pause stops accepting and dialing new peers, e.g. during maintenance or when the
+// node is overloaded. Connected peers are kept. New inbound connections are closed
+// with a busy reason until Resume.
+func (srv *Server) Pause() {
+	atomic.StoreInt32(&srv.paused, 1)
+}
+
+// Resume accepts and dials new peers again after Pause.
+func (srv *Server) Resume() {
+	atomic.StoreInt32(&srv.paused, 0)
+}
+
+func (srv *Server) isPaused() bool {
+	return atomic.LoadInt32(&srv.paused) != 0
+}
+
+func (srv *Server) isRunning() bool {
+	return atomic.LoadInt32(&srv.running) == 1
+}
+
+// Stop terminates the server and all active peer connections.
+// It blocks until all active connections are closed, or returns ErrShutdownTimeout
+// after ShutdownTimeout with remaining connections closed by force.
+func (srv *Server) Stop() error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if !srv.isRunning() {
+		return nil
+	}
+	atomic.StoreInt32(&srv.running, 0)
+	for _, listener := range srv.listeners {
+		listener.Close()
+	}
+	srv.listeners = nil
+	close(srv.quit)
+	defer srv.discovery.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		srv.loopWG.Wait()
+		close(done)
+	}()
+	timeout := defaultShutdownTimeout
+	if srv.ShutdownTimeout > 0 {
+		timeout = srv.ShutdownTimeout
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	srv.connsLock.Lock()
+	for fd := range srv.conns {
+		fd.Close()
+	}
+	// connections in handshake or of peers are suspected to hold up the shutdown
+	srv.log.Error("p2p.Stop shutdown timeout, %d connections of handshakes and peers closed by force", len(srv.conns))
+	srv.connsLock.Unlock()
+	return ErrShutdownTimeout
+}
+
+// trackConn records fd until untrackConn, so that it can be closed by force if
+// shutdown times out
+func (srv *Server) trackConn(fd net.Conn) {
+	srv.connsLock.Lock()
+	defer srv.connsLock.Unlock()
+	srv.conns[fd] = struct{}{}
+}
+
+func (srv *Server) untrackConn(fd net.Conn) {
+	srv.connsLock.Lock()
+	defer srv.connsLock.Unlock()
+	delete(srv.conns, fd)
+}
+
+// AdvertisedPorts returns the TCP and UDP ports announced to other nodes by discovery.
+// It returns zeros before Start.
+func (srv *Server) AdvertisedPorts() (tcpPort, udpPort int) {
+	if srv.discovery == nil {
+		return 0, 0
+	}
+	return srv.discovery.AdvertisedPorts()
+}
+
+// SetAdvertisedPorts changes the announced TCP and UDP ports at runtime, e.g. after
+// NAT mapping changes, and re-announces them to known nodes. It returns ErrServerNotRunning
+// if the server is not running.
+func (srv *Server) SetAdvertisedPorts(tcpPort, udpPort int) error {
+	if !srv.isRunning() {
+		return ErrServerNotRunning
+	}
+	srv.discovery.SetAdvertisedPorts(tcpPort, udpPort)
+	return nil
+}
+
+// LocalNode returns the node record of self with the advertised ports. The IP is
+// AdvertisedIP, or the host of ListenAddr if it is a specific address. Discovery
+// does not learn the external address of self, so the IP is nil if the server
+// listens on all interfaces without AdvertisedIP. It returns nil if the server
+// is not running.
+func (srv *Server) LocalNode() *discovery.Node {
+	if !srv.isRunning() {
+		return nil
+	}
+	ip := srv.AdvertisedIP
+	if ip == nil {
+		// the listeners are closed by Stop, the address resolved by Start is kept
+		if host, _, err := net.SplitHostPort(srv.ListenAddr); err == nil {
+			if listenIP := net.ParseIP(host); listenIP != nil && !listenIP.IsUnspecified() {
+				ip = listenIP
+			}
+		}
+	}
+	tcpPort, udpPort := srv.AdvertisedPorts()
+	node := discovery.NewNode(common.HexToAddress(srv.MyNodeID), ip, udpPort)
+	node.TCPPort = tcpPort
+	return node
+}
+
+// KnownNodes returns a snapshot of the nodes in the discovery database, which
+// may not be connected. It returns nil before Start.
+func (srv *Server) KnownNodes() []*discovery.Node {
+	if srv.kadDB == nil {
+		return nil
+	}
+	nodeMap := srv.kadDB.GetCopy()
+	nodes := make([]*discovery.Node, 0, len(nodeMap))
+	for _, node := range nodeMap {
+		n := *node
+		nodes = append(nodes, &n)
+	}
+	return nodes
+}
+
 func (srv *Server) run() {
 	defer srv.loopWG.Done()
+	defer close(srv.runDone)
 	peers := srv.peers
 	srv.log.Info("p2p start running...")
 	checkTimer := time.NewTimer(10 * time.Second)
@@ -138,22 +659,45 @@ running:
 		case <-srv.quit:
 			// The server was stopped. Run the cleanup logic.
 			break running
-		case c := <-srv.addpeer:
-			srv.log.Info("server.run  <-srv.addpeer, %s", c)
+		case req := <-srv.addpeer:
+			c := req.peer
+			c.log.Debug("server.run addpeer")
+			// rejected peers are disconnected by their own goroutine before they
+			// run, as the run loop must not wait on protocols
 			_, ok := peers[c.node.ID]
 			if ok {
 				// node already connected, need close this connection
-				c.Disconnect(discAlreadyConnected)
+				req.result <- discAlreadyConnected
+			} else if !srv.hasPeerSlot(len(peers), c.inbound) {
+				req.result <- discTooManyPeers
 			} else {
+				req.result <- 0
 				peers[c.node.ID] = c
+				if c.inbound {
+					atomic.AddInt32(&srv.inboundPeers, 1)
+				}
+				atomic.StoreInt64(&srv.noPeersSince, 0)
+				srv.peerCache.add(c.node)
+				srv.metrics.setVar(varPeers, int64(len(peers)))
 			}
+		case op := <-srv.peerOp:
+			op(peers)
+			srv.peerOpDone <- struct{}{}
 		case pd := <-srv.delpeer:
 			curPeer, ok := peers[pd.node.ID]
 			if ok && curPeer == pd {
-				srv.log.Info("server.run delpeer recved. peer match. remove peer. %s", pd)
+				pd.log.Debug("server.run delpeer, remove peer")
 				delete(peers, pd.node.ID)
+				if pd.inbound {
+					atomic.AddInt32(&srv.inboundPeers, -1)
+				}
+				if len(peers) == 0 {
+					atomic.StoreInt64(&srv.noPeersSince, time.Now().UnixNano())
+				}
+				srv.metrics.setVar(varPeers, int64(len(peers)))
+				srv.peerQuit(pd)
 			} else {
-				srv.log.Info("server.run delpeer recved. peer not match")
+				pd.log.Debug("server.run delpeer, peer not match")
 			}
 		}
 	}
@@ -165,30 +709,111 @@ running:
 
 	for len(peers) > 0 {
 		p := <-srv.delpeer
+		if peers[p.node.ID] != p {
+			continue
+		}
 		delete(peers, p.node.ID)
+		if p.inbound {
+			atomic.AddInt32(&srv.inboundPeers, -1)
+		}
+		srv.metrics.setVar(varPeers, int64(len(peers)))
+		srv.peerQuit(p)
 	}
 }
 
+// peerQuit handles a removed peer by the reason it quits, see reconnectPolicy.
+// Peers disconnected for protocol error or hostile ones are not redialed soon.
+func (srv *Server) peerQuit(p *Peer) {
+	reason, ok := p.discReason()
+	fields := log.Fields{}
+	if ok {
+		fields["reason"] = reason
+	}
+	p.log.WithFields(fields).Info("p2p.peerQuit err=%s", p.err)
+	if ok {
+		srv.reconnect.record(p.node.ID, reason, time.Now())
+		if reason == discProtocolError || hostileReason(reason) {
+			srv.peerCache.remove(p.node.ID)
+		}
+	}
+	srv.quality.observe(p.node.ID, time.Duration(monotime.Now()-p.created))
+	srv.metrics.peerDisconnected(p)
+}
+
+// maxInboundPeers returns the maximum number of inbound peers, zero means no limit
+func (srv *Server) maxInboundPeers() int {
+	if srv.MaxPeers <= 0 {
+		return 0
+	}
+	reserve := srv.OutboundReserve
+	if reserve == 0 {
+		reserve = defaultOutboundReserve
+	}
+	if reserve < 0 {
+		return srv.MaxPeers
+	}
+	return srv.MaxPeers - int(math.Ceil(float64(srv.MaxPeers)*reserve))
+}
+
+// inboundFull reports whether no slot is left for inbound peers
+func (srv *Server) inboundFull() bool {
+	maxInbound := srv.maxInboundPeers()
+	return srv.MaxPeers > 0 && int(atomic.LoadInt32(&srv.inboundPeers)) >= maxInbound
+}
+
+// hasPeerSlot reports whether a peer can be added to numPeers connected peers
+func (srv *Server) hasPeerSlot(numPeers int, inbound bool) bool {
+	if srv.MaxPeers <= 0 {
+		return true
+	}
+	if inbound && srv.inboundFull() {
+		return false
+	}
+	return numPeers < srv.MaxPeers
+}
+
 //scheduleTasks
 func (srv *Server) scheduleTasks() {
+	if srv.kadDB == nil || srv.isPaused() {
+		return
+	}
 	// TODO select nodes from ntab to connect
 	nodeMap := srv.kadDB.GetCopy()
-	srv.log.Info("scheduleTasks called... [%d]", len(nodeMap))
+	srv.log.Debug("scheduleTasks called... [%d]", len(nodeMap))
+	maxJitter := srv.dialJitter()
+	now := time.Now()
+	var candidates []*discovery.Node
 	for _, node := range nodeMap {
 		_, ok := srv.peers[node.ID]
 		if ok {
 			continue
 		}
-		//TODO UDPPort==> TCPPort
-		addr, _ := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", node.IP.String(), node.UDPPort))
-		conn, err := net.DialTimeout("tcp", addr.String(), defaultDialTimeout)
-		if err != nil {
-			if conn != nil {
-				conn.Close()
-			}
+		if !srv.reconnect.allowed(node.ID) {
 			continue
 		}
-		go srv.setupConn(conn, outboundConn, node)
+		if srv.dialHistory.ready(node.ID, now) {
+			candidates = append(candidates, node)
+		}
+	}
+	// dial nodes of better quality first when peer slots are limited
+	count := len(candidates)
+	if srv.MaxPeers > 0 && srv.MaxPeers-len(srv.peers) < count {
+		count = srv.MaxPeers - len(srv.peers)
+	}
+	for _, node := range srv.quality.selectNodes(candidates, count) {
+		srv.dialHistory.add(node.ID, now, dialHistoryExpiry+jitter(maxJitter))
+
+		delay := jitter(maxJitter)
+		srv.loopWG.Add(1)
+		go func(node *discovery.Node) {
+			defer srv.loopWG.Done()
+			select {
+			case <-time.After(delay):
+			case <-srv.quit:
+				return
+			}
+			srv.dial(node)
+		}(node)
 	}
 	/*for _, node := range srv.StaticNodes {
 		_, ok := srv.peers[node.ID]
@@ -208,26 +833,214 @@ func (srv *Server) scheduleTasks() {
 	}*/
 }
 
-func (srv *Server) startListening() error {
-	// Launch the TCP listener.
-	listener, err := net.Listen("tcp", srv.ListenAddr)
+// ExportPeers returns the records of recently connected good peers, which can be
+// saved and imported by ImportPeers at next start. It works after Stop.
+func (srv *Server) ExportPeers() []byte {
+	data, err := srv.peerCache.encode()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// ImportPeers loads the records exported by ExportPeers, the nodes are dialed at
+// next Start to seed dialing before discovery warms up, a later restart does not
+// dial them again. Nothing is imported if data is malformed, records that cannot be
+// dialed are skipped. It should be called before Start.
+func (srv *Server) ImportPeers(data []byte) error {
+	nodes, err := decodePeerRecords(data)
 	if err != nil {
 		return err
 	}
-	laddr := listener.Addr().(*net.TCPAddr)
-	srv.ListenAddr = laddr.String()
-	srv.listener = listener
+	srv.lock.Lock()
+	srv.imported = nodes
+	srv.lock.Unlock()
+	return nil
+}
+
+// bootstrap seeds discovery with the bootstrap and imported nodes and dials them once.
+// The imported nodes are consumed. It is called by Start with srv.lock held.
+func (srv *Server) bootstrap() {
+	nodes := append(append([]*discovery.Node(nil), srv.BootstrapNodes...), srv.imported...)
+	srv.imported = nil
+	if len(nodes) == 0 {
+		return
+	}
+	srv.discovery.Bootstrap(nodes)
+	now := time.Now()
+	for _, node := range nodes {
+		if !srv.dialHistory.add(node.ID, now, dialHistoryExpiry) {
+			continue
+		}
+		srv.loopWG.Add(1)
+		go func(node *discovery.Node) {
+			defer srv.loopWG.Done()
+			srv.dial(node)
+		}(node)
+	}
+}
+
+func (srv *Server) dialJitter() time.Duration {
+	if srv.DialJitter == 0 {
+		return defaultDialJitter
+	}
+	return srv.DialJitter
+}
+
+// dial connects to node unless the connection gater denies it, the scheduled,
+// bootstrap and imported nodes are all dialed by it.
+func (srv *Server) dial(node *discovery.Node) {
+	if srv.ConnectionGater != nil && !srv.ConnectionGater.InterceptDial(node) {
+		return
+	}
+	var dialer Dialer = srv.transport()
+	if srv.Dialer != nil {
+		dialer = srv.Dialer
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDialTimeout)
+	defer cancel()
+	// the dial is canceled by Stop. quit is read here, the goroutine may outlive
+	// the dial and see srv.quit of a restarted server.
+	quit := srv.quit
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	network, addr := splitNetAddr(srv.dialAddr(node))
+	srv.metrics.addVar(varDialsAttempted, 1)
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		srv.metrics.addVar(varDialsFailed, 1)
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	srv.setupConn(conn, outboundConn, node)
+}
+
+// dialAddr returns the address to dial node
+func (srv *Server) dialAddr(node *discovery.Node) string {
+	if addr, ok := srv.NodeAddrs[node.ID]; ok {
+		return addr
+	}
+	if node.TCPPort != 0 {
+		return net.JoinHostPort(node.IP.String(), strconv.Itoa(node.TCPPort))
+	}
+	//TODO UDPPort==> TCPPort
+	return net.JoinHostPort(node.IP.String(), strconv.Itoa(node.UDPPort))
+}
+
+// splitNetAddr returns the network and address of addr, "unix:/path" is a
+// unix domain socket and others are tcp addresses.
+func splitNetAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixAddrPrefix)
+	}
+	return "tcp", addr
+}
+
+// exchangeProtoTable sends the negotiated protoCode table to the remote and checks
+// the remote computed the same one, so that frames are not routed to another protocol.
+func exchangeProtoTable(peer *Peer, table []capUpdate, timeout time.Duration) error {
+	payload, err := common.Serialize(table)
+	if err != nil {
+		return err
+	}
+	tableMsg := &msg{
+		protoCode: ctlProtoCode,
+		Message: Message{
+			msgCode: ctlMsgProtoTable,
+			size:    uint32(len(payload)),
+			payload: payload,
+		},
+	}
+	if err = peer.writeRawMsg(tableMsg, timeout); err != nil {
+		return err
+	}
+
+	recv, err := peer.readRawMsg(timeout)
+	if err != nil {
+		return err
+	}
+	// the remote may reject the conn after its handshake instead of the table
+	if err = remoteDisc(recv); err != nil {
+		return err
+	}
+	if recv.protoCode != ctlProtoCode || recv.msgCode != ctlMsgProtoTable {
+		return errors.New("second message is not protoCode table")
+	}
+	var remoteTable []capUpdate
+	if err = recv.Decode(&remoteTable); err != nil {
+		return err
+	}
+	if !equalProtoTables(table, remoteTable) {
+		return errProtoTableDiff
+	}
+	return nil
+}
+
+// remoteDisc returns the peer error of the reason in recv if it is a disc frame, or nil
+func remoteDisc(recv *msg) error {
+	if recv.protoCode != ctlProtoCode || recv.msgCode != ctlMsgDiscCode {
+		return nil
+	}
+	var reason uint
+	if err := recv.Decode(&reason); err != nil {
+		return err
+	}
+	return newPeerError(reason, errRemoteDisc)
+}
+
+// listenerAddr returns the address of listener in the form of ListenAddr
+func listenerAddr(listener net.Listener) string {
+	if addr, ok := listener.Addr().(*net.UnixAddr); ok {
+		return unixAddrPrefix + addr.Name
+	}
+	return listener.Addr().String()
+}
+
+func (srv *Server) startListening() error {
+	// Launch the listeners, the resolved addresses are written back.
+	addrs := append([]string{srv.ListenAddr}, srv.ListenAddrs...)
+	for _, addr := range addrs {
+		listener, err := srv.transport().Listen(splitNetAddr(addr))
+		if err != nil {
+			for _, l := range srv.listeners {
+				l.Close()
+			}
+			srv.listeners = nil
+			return err
+		}
+		srv.listeners = append(srv.listeners, listener)
+	}
+	srv.ListenAddr = listenerAddr(srv.listeners[0])
+	for i := range srv.ListenAddrs {
+		srv.ListenAddrs[i] = listenerAddr(srv.listeners[i+1])
+	}
 	srv.loopWG.Add(1)
-	go srv.listenLoop()
+	go srv.listenLoop(srv.listeners)
 	return nil
 }
 
+// transport returns the transport of config, or the default one of real sockets
+func (srv *Server) transport() Transport {
+	if srv.Transport != nil {
+		return srv.Transport
+	}
+	return &netTransport{}
+}
+
 type tempError interface {
 	Temporary() bool
 }
 
 // listenLoop runs in its own goroutine and accepts inbound connections.
-func (srv *Server) listenLoop() {
+// Connections accepted by all listeners share the same handshake slots.
+func (srv *Server) listenLoop(listeners []net.Listener) {
 	defer srv.loopWG.Done()
 	// If all slots are taken, no further connections are accepted.
 	tokens := maxAcceptConns
@@ -239,6 +1052,25 @@ func (srv *Server) listenLoop() {
 		slots <- struct{}{}
 	}
 
+	concurrency := 1
+	if srv.AcceptConcurrency > 0 {
+		concurrency = srv.AcceptConcurrency
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(listeners) * concurrency)
+	for _, listener := range listeners {
+		for i := 0; i < concurrency; i++ {
+			go func(listener net.Listener) {
+				defer wg.Done()
+				srv.acceptLoop(listener, slots)
+			}(listener)
+		}
+	}
+	wg.Wait()
+}
+
+// acceptLoop accepts connections of one listener until it is closed.
+func (srv *Server) acceptLoop(listener net.Listener, slots chan struct{}) {
 	for {
 		// Wait for a handshake slot before accepting.
 		<-slots
@@ -247,15 +1079,38 @@ func (srv *Server) listenLoop() {
 			err error
 		)
 		for {
-			fd, err = srv.listener.Accept()
+			fd, err = listener.Accept()
 			if tempErr, ok := err.(tempError); ok && tempErr.Temporary() {
 				continue
 			} else if err != nil {
 				srv.log.Error("p2p.listenLoop accept err. %s", err)
+				atomic.StoreInt32(&srv.listenerDown, 1)
 				return
 			}
 			break
 		}
+		// reject at once without handshake if paused or inbound slots are taken
+		if srv.isPaused() {
+			srv.log.WithFields(log.Fields{"peer": fd.RemoteAddr().String(), "direction": "inbound"}).Debug("p2p.listenLoop paused, reject")
+			go func() {
+				newPeer(fd, srv.log).sendDiscMsg(discBusy)
+				fd.Close()
+			}()
+			slots <- struct{}{}
+			continue
+		}
+		if srv.inboundFull() {
+			srv.log.WithFields(log.Fields{"peer": fd.RemoteAddr().String(), "direction": "inbound"}).Debug("p2p.listenLoop too many inbound peers, reject")
+			fd.Close()
+			slots <- struct{}{}
+			continue
+		}
+		if srv.ConnectionGater != nil && !srv.ConnectionGater.InterceptAccept(fd.RemoteAddr()) {
+			srv.log.WithFields(log.Fields{"peer": fd.RemoteAddr().String(), "direction": "inbound"}).Debug("p2p.listenLoop denied by gater")
+			fd.Close()
+			slots <- struct{}{}
+			continue
+		}
 		go func() {
 			srv.setupConn(fd, inboundConn, nil)
 			slots <- struct{}{}
@@ -263,75 +1118,212 @@ func (srv *Server) listenLoop() {
 	}
 }
 
-// setupConn TODO add encypt-handshake.
-func (srv *Server) setupConn(fd net.Conn, flags int, dialDest *discovery.Node) error {
-	peer := &Peer{
-		conn:     fd,
-		created:  monotime.Now(),
-		disc:     make(chan uint),
-		closed:   make(chan struct{}),
-		protoMap: make(map[uint16]*Protocol),
-		capMap:   make(map[string]uint16),
-		log:      srv.log,
-		node:     dialDest,
-	}
-
-	var caps []Cap
-	for _, proto := range srv.Protocols {
-		caps = append(caps, proto.GetBaseProtocol().cap())
+// configureConn applies the socket options of config on tcp connections
+func (srv *Server) configureConn(fd net.Conn) error {
+	tcpConn, ok := fd.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetNoDelay(!srv.TCPNagle); err != nil {
+		return err
+	}
+	period := defaultTCPKeepAlivePeriod
+	if srv.TCPKeepAlivePeriod != 0 {
+		period = srv.TCPKeepAlivePeriod
+	}
+	if err := tcpConn.SetKeepAlive(period > 0); err != nil {
+		return err
+	}
+	if period > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(period); err != nil {
+			return err
+		}
+	}
+	if srv.TCPReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(srv.TCPReadBuffer); err != nil {
+			return err
+		}
+	}
+	if srv.TCPWriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(srv.TCPWriteBuffer); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// newHandshakeMsg returns the handshake frame of self with caps and a random nonce
+func (srv *Server) newHandshakeMsg(caps []Cap) (*msg, error) {
+	// the global source is safe for concurrent use and not allocated per connection
+	myNounce := rand.Uint32()
+	for myNounce == 0 {
+		myNounce = rand.Uint32()
+	}
+	handshakeMsg := &protoHandShake{Caps: caps, Nounce: myNounce, NetworkID: srv.NetworkID}
+	if tcpPort, _ := srv.AdvertisedPorts(); tcpPort > 0 && tcpPort <= math.MaxUint16 {
+		handshakeMsg.TCPPort = uint16(tcpPort)
+	}
+	nodeID := common.HexToAddress(srv.MyNodeID)
+	copy(handshakeMsg.NodeID[0:], nodeID[0:])
+
+	// Serialize should handle big- little- endian?
+	buffer, err := common.Serialize(handshakeMsg)
+	if err != nil {
+		return nil, err
+	}
+	// buffer is a fresh slice, it is used as the payload without copy
 	wrapMsg := &msg{
 		protoCode: ctlProtoCode,
 		Message: Message{
 			msgCode: ctlMsgProtoHandshake,
+			size:    uint32(len(buffer)),
+			payload: buffer,
 		},
 	}
+	return wrapMsg, nil
+}
 
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	myNounce := r.Uint32()
-	handshakeMsg := &protoHandShake{caps: caps, nounce: myNounce}
-	nodeID := common.HexToAddress(srv.MyNodeID)
-	copy(handshakeMsg.nodeID[0:], nodeID[0:])
+// setupConn TODO add encypt-handshake.
+func (srv *Server) setupConn(fd net.Conn, flags int, dialDest *discovery.Node) (err error) {
+	srv.trackConn(fd)
+	defer func() {
+		if err != nil {
+			srv.untrackConn(fd)
+			srv.metrics.addVar(varHandshakeFailures, 1)
+		} else {
+			srv.metrics.addVar(varHandshakeSuccesses, 1)
+		}
+	}()
+	if err := srv.configureConn(fd); err != nil {
+		fd.Close()
+		return err
+	}
 
-	// Serialize should handle big- little- endian?
-	buffer, err := common.Serialize(handshakeMsg)
+	peer := newPeer(fd, srv.log)
+	peer.node = dialDest
+	peer.inbound = flags == inboundConn
+	peer.metrics = srv.metrics
+	peer.lookupProto = srv.findProtocol
+	if srv.MinReadThroughput != 0 {
+		peer.minReadThroughput = srv.MinReadThroughput
+	}
+	if srv.MaxMsgRate != 0 {
+		peer.maxMsgRate = srv.MaxMsgRate
+	}
+
+	// record keeps the reason a dialed node is rejected for to schedule its redial,
+	// and reject disconnects the conn for reason
+	record := func(reason uint) {
+		if flags == outboundConn {
+			srv.reconnect.record(dialDest.ID, reason, time.Now())
+		}
+	}
+	reject := func(reason uint) {
+		record(reason)
+		peer.sendDiscMsg(reason)
+		fd.Close()
+	}
+
+	protocols := srv.protocols()
+	caps := make([]Cap, 0, len(protocols))
+	for _, proto := range protocols {
+		caps = append(caps, proto.GetBaseProtocol().cap())
+	}
+	wrapMsg, err := srv.newHandshakeMsg(caps)
 	if err != nil {
 		fd.Close()
 		return err
 	}
-	wrapMsg.payload = make([]byte, len(buffer))
-	copy(wrapMsg.payload, buffer)
-	wrapMsg.size = uint32(len(wrapMsg.payload))
-	peer.sendRawMsg(wrapMsg)
+	handshakeTimeout := defaultHandshakeTimeout
+	if srv.HandshakeTimeout > 0 {
+		handshakeTimeout = srv.HandshakeTimeout
+	}
+	if err = peer.writeRawMsg(wrapMsg, handshakeTimeout); err != nil {
+		fd.Close()
+		return err
+	}
 
-	recvWrapMsg, err := peer.recvRawMsg()
+	recvWrapMsg, err := peer.readRawMsg(handshakeTimeout)
 	if err != nil {
 		fd.Close()
 		return err
 	}
 
-	var recvMsg protoHandShake
-	if err := common.Deserialize(recvWrapMsg.payload, recvMsg); err != nil {
-		fd.Close()
+	// the remote may reject the dial with a reason instead of handshake
+	if flags == outboundConn {
+		if err := remoteDisc(recvWrapMsg); err != nil {
+			fd.Close()
+			if perr, ok := err.(*peerError); ok {
+				record(perr.reason)
+			}
+			return err
+		}
+	}
+	if recvWrapMsg.protoCode != ctlProtoCode || recvWrapMsg.msgCode != ctlMsgProtoHandshake {
+		reject(discProtocolError)
+		return errors.New("first message is not handshake")
+	}
+
+	maxCaps := defaultMaxHandshakeCaps
+	if srv.MaxHandshakeCaps > 0 {
+		maxCaps = srv.MaxHandshakeCaps
+	}
+	recvMsg, err := decodeHandshake(recvWrapMsg.payload, maxCaps)
+	if err != nil {
+		reject(discProtocolError)
 		return err
 	}
 
-	peerCaps, peerNodeID, peerNounce := recvMsg.caps, recvMsg.nodeID, recvMsg.nounce
-	// TODO need merge caps and order by cap name, make sure having the same order at each end
+	peerCaps, peerNodeID, peerNounce, peerTCPPort := recvMsg.Caps, recvMsg.NodeID, recvMsg.Nounce, recvMsg.TCPPort
+	if recvMsg.NetworkID != srv.NetworkID {
+		reject(discNetworkMismatch)
+		return fmt.Errorf("network ID %d mismatch, want %d", recvMsg.NetworkID, srv.NetworkID)
+	}
+	if err := srv.nonces.check(common.Address(peerNodeID), peerNounce, time.Now()); err != nil {
+		reject(discHandshakeReject)
+		return err
+	}
+	if srv.ConnectionGater != nil && !srv.ConnectionGater.InterceptSecured(peer.inbound, common.Address(peerNodeID), fd.RemoteAddr()) {
+		reject(discHandshakeReject)
+		return errConnGated
+	}
+	if srv.HandshakeValidator != nil {
+		if err := srv.HandshakeValidator(peerCaps, common.Address(peerNodeID)); err != nil {
+			reason := uint(discHandshakeReject)
+			if srv.HandshakeRejectReason != 0 {
+				reason = srv.HandshakeRejectReason
+			}
+			reject(reason)
+			return err
+		}
+	}
 	// TODO compute a secret key by myNounce and peerNounce
-	protoCode := uint16(baseProtoCode)
-	for _, proto := range srv.Protocols {
-		peer.protoMap[protoCode] = proto.GetBaseProtocol()
-		baseProtocol := proto.GetBaseProtocol()
-		myCap := baseProtocol.cap()
-		str1 := myCap.String()
-		fmt.Println(str1)
-		peer.capMap[proto.GetBaseProtocol().cap().String()] = protoCode
-		protoCode++
+	table := negotiateProtoCodes(caps, peerCaps)
+	if len(table) == 0 {
+		reject(discUselessPeer)
+		return errNoSharedCaps
+	}
+	if err := exchangeProtoTable(peer, table, handshakeTimeout); err != nil {
+		if perr, ok := err.(*peerError); ok && perr.err == errRemoteDisc {
+			fd.Close()
+			record(perr.reason)
+			return err
+		}
+		reject(discProtocolError)
+		return err
+	}
+	for _, entry := range table {
+		peer.protoMap[entry.ProtoCode] = srv.findProtocol(entry.Cap)
+		peer.capMap[entry.Cap.String()] = entry.ProtoCode
 	}
 
 	var peerNode *discovery.Node
-	if flags == inboundConn {
+	if flags == outboundConn {
+		if bytes.Equal(dialDest.ID[0:], peerNodeID[0:]) {
+			peerNode = dialDest
+		}
+	} else {
 		nodeMap := srv.kadDB.GetCopy()
 		for _, node := range nodeMap {
 			if bytes.Equal(node.ID[0:], peerNodeID[0:]) {
@@ -339,18 +1331,46 @@ func (srv *Server) setupConn(fd net.Conn, flags int, dialDest *discovery.Node) e
 				break
 			}
 		}
+		// a node unknown to discovery is accepted by its valid handshake, and
+		// can be dialed back at its advertised port if any
+		if peerNode == nil {
+			var ip net.IP
+			if tcpAddr, ok := fd.RemoteAddr().(*net.TCPAddr); ok {
+				ip = tcpAddr.IP
+			}
+			peerNode = discovery.NewNode(common.Address(peerNodeID), ip, 0)
+			peerNode.TCPPort = int(peerTCPPort)
+		}
 	}
 	if peerNode == nil {
-		return errors.New("Not found nodeID in discovery database!")
+		reject(discImpersonation)
+		return errors.New("nodeID does not match the dialed node")
 	}
 	peer.node = peerNode
-	srv.log.Info("p2p.setupConn conn handshaked. peer=%s peerNounce=%u peerCaps=%s", peer, peerNounce, peerCaps)
+	peer.log = srv.log.WithFields(peer.logFields())
+	peer.log.Info("p2p.setupConn conn handshaked. peerNounce=%d peerCaps=%v", peerNounce, peerCaps)
+	srv.loopWG.Add(1)
 	go func() {
-		srv.loopWG.Add(1)
-		srv.addpeer <- peer
+		defer srv.loopWG.Done()
+		defer srv.untrackConn(fd)
+		req := addPeerReq{peer, make(chan uint, 1)}
+		select {
+		case srv.addpeer <- req:
+		case <-srv.quit:
+			fd.Close()
+			return
+		}
+		if reason := <-req.result; reason != 0 {
+			peer.log.Debug("p2p.setupConn peer rejected, reason=%d", reason)
+			peer.sendDiscMsg(reason)
+			fd.Close()
+			return
+		}
 		peer.run()
-		srv.delpeer <- peer
-		srv.loopWG.Done()
+		select {
+		case srv.delpeer <- peer:
+		case <-srv.runDone:
+		}
 	}()
 	return nil
 }
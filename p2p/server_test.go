@@ -0,0 +1,1741 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/common/hexutil"
+	"github.com/seeleteam/go-seele/log"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+// testServerProtocol forwards peers and messages to buffered channels for assertion
+type testServerProtocol struct {
+	Protocol
+	added   chan *Peer
+	deleted chan *Peer
+	msgs    chan *Message
+}
+
+func newTestServerProtocol(name string) *testServerProtocol {
+	return &testServerProtocol{
+		Protocol: Protocol{
+			Name:      name,
+			Version:   1,
+			AddPeerCh: make(chan *Peer),
+			DelPeerCh: make(chan *Peer),
+			ReadMsgCh: make(chan *Message),
+		},
+		added:   make(chan *Peer, 64),
+		deleted: make(chan *Peer, 64),
+		msgs:    make(chan *Message, 64),
+	}
+}
+
+func (p *testServerProtocol) Run() {
+	for {
+		select {
+		case peer := <-p.AddPeerCh:
+			p.added <- peer
+		case peer := <-p.DelPeerCh:
+			p.deleted <- peer
+		case m := <-p.ReadMsgCh:
+			p.msgs <- m
+		}
+	}
+}
+
+func (p *testServerProtocol) GetBaseProtocol() *Protocol {
+	return &p.Protocol
+}
+
+func (p *testServerProtocol) waitAdded(t *testing.T) *Peer {
+	select {
+	case peer := <-p.added:
+		return peer
+	case <-time.After(3 * time.Second):
+		t.Fatal("peer is not added")
+	}
+	return nil
+}
+
+// newTestNode creates a node with random ID, its UDP port refuses tcp dial quickly
+func newTestNode(t *testing.T) *discovery.Node {
+	id, err := common.GenerateRandomAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return discovery.NewNode(*id, net.ParseIP("127.0.0.1"), 1)
+}
+
+func newTestServer(t *testing.T, protos ...ProtocolInterface) *Server {
+	self := newTestNode(t)
+	return &Server{
+		Config: Config{
+			Name:       "test",
+			MyNodeID:   hexutil.BytesToHex(self.ID.Bytes()),
+			KadPort:    "0",
+			ListenAddr: "127.0.0.1:0",
+			Protocols:  protos,
+		},
+	}
+}
+
+// testHandshake does the handshake on conn as a remote node with nodeID, and
+// accepts the protoCode table of the server
+func testHandshake(t *testing.T, conn net.Conn, nodeID common.Address, caps []Cap) *Peer {
+	return testEchoProtoTable(t, testHandshakeOnly(t, conn, nodeID, caps))
+}
+
+// testEchoProtoTable receives the protocol table of the server, registers it and sends it back
+func testEchoProtoTable(t *testing.T, p *Peer) *Peer {
+	recv, err := p.recvRawMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, recv.Code(), ctlMsgProtoTable)
+	var table []capUpdate
+	if err = recv.Decode(&table); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range table {
+		p.protoMap[entry.ProtoCode] = newTestProtocol(entry.Cap.Name)
+		p.capMap[entry.Cap.String()] = entry.ProtoCode
+	}
+	recv.protoCode = ctlProtoCode
+	if err = p.sendRawMsg(recv); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testHandshakeOnly sends and receives the handshake on conn as a remote node with nodeID
+func testHandshakeOnly(t *testing.T, conn net.Conn, nodeID common.Address, caps []Cap) *Peer {
+	return testHandshakeNounce(t, conn, nodeID, caps, rand.Uint32()|1)
+}
+
+// testHandshakeNounce is testHandshakeOnly with the given handshake nonce
+func testHandshakeNounce(t *testing.T, conn net.Conn, nodeID common.Address, caps []Cap, nounce uint32) *Peer {
+	hs := &protoHandShake{Caps: caps, Nounce: nounce}
+	copy(hs.NodeID[0:], nodeID[0:])
+	return testHandshakeMsg(t, conn, hs)
+}
+
+// testHandshakeMsg sends hs and receives the handshake of the server on conn
+func testHandshakeMsg(t *testing.T, conn net.Conn, hs *protoHandShake) *Peer {
+	p := newPeer(conn, log.GetLogger("p2p", true))
+	payload, err := common.Serialize(hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsMsg := &msg{
+		protoCode: ctlProtoCode,
+		Message:   Message{msgCode: ctlMsgProtoHandshake, size: uint32(len(payload)), payload: payload},
+	}
+	if err = p.sendRawMsg(hsMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	recv, err := p.recvRawMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, recv.Code(), ctlMsgProtoHandshake)
+	return p
+}
+
+func Test_Server_DualStackListen(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	srv.ListenAddrs = []string{"[::1]:0"}
+	node4, node6 := newTestNode(t), newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node4, node6}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn4, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn4.Close()
+	testHandshake(t, conn4, node4.ID, []Cap{proto.cap()})
+	assert.Equal(t, proto.waitAdded(t).node.ID, node4.ID)
+
+	conn6, err := net.Dial("tcp", srv.ListenAddrs[0])
+	assert.Equal(t, err, nil)
+	defer conn6.Close()
+	testHandshake(t, conn6, node6.ID, []Cap{proto.cap()})
+	assert.Equal(t, proto.waitAdded(t).node.ID, node6.ID)
+}
+
+func Test_Server_StopClosesListeners(t *testing.T) {
+	srv := newTestServer(t)
+	srv.ListenAddrs = []string{"[::1]:0"}
+	assert.Equal(t, srv.Start(), nil)
+	srv.Stop()
+
+	for _, addr := range []string{srv.ListenAddr, srv.ListenAddrs[0]} {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("listener %s is not closed", addr)
+		}
+	}
+}
+
+func Test_Server_Restart(t *testing.T) {
+	srv := newTestServer(t)
+	assert.Equal(t, srv.Start(), nil)
+	srv.Stop()
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	// the listener of the restarted server handshakes
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	p := newPeer(conn, log.GetLogger("p2p", true))
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgProtoHandshake)
+
+	healthy, reason := srv.Healthy()
+	assert.Equal(t, healthy, true, reason)
+}
+
+func Test_Server_HandshakeTooManyCaps(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	srv.MaxHandshakeCaps = 2
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	caps := []Cap{proto.cap(), {"a", 1}, {"b", 1}}
+	p := testHandshakeOnly(t, conn, node.ID, caps)
+
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(discProtocolError))
+
+	select {
+	case <-proto.added:
+		t.Fatal("peer with too many caps is added")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_Server_HandshakeValidator(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	accepted, rejected := newTestNode(t), newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{accepted, rejected}
+	srv.HandshakeRejectReason = 100
+	srv.HandshakeValidator = func(caps []Cap, nodeID common.Address) error {
+		if nodeID == rejected.ID {
+			return errors.New("wrong network")
+		}
+		return nil
+	}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	p := testHandshakeOnly(t, conn, rejected.ID, []Cap{proto.cap()})
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(100))
+
+	select {
+	case <-proto.added:
+		t.Fatal("rejected peer is added")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn2, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn2.Close()
+	testHandshake(t, conn2, accepted.ID, []Cap{proto.cap()})
+	assert.Equal(t, proto.waitAdded(t).node.ID, accepted.ID)
+}
+
+func Test_Server_DialJitter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	dialed := make(chan time.Time, 32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dialed <- time.Now()
+			conn.Close()
+		}
+	}()
+
+	const nodeCount = 20
+	srv := newTestServer(t)
+	srv.DialJitter = 500 * time.Millisecond
+	for i := 0; i < nodeCount; i++ {
+		node := newTestNode(t)
+		node.UDPPort = listener.Addr().(*net.TCPAddr).Port
+		srv.StaticNodes = append(srv.StaticNodes, node)
+	}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	var first, last time.Time
+	for i := 0; i < nodeCount; i++ {
+		select {
+		case at := <-dialed:
+			if first.IsZero() {
+				first = at
+			}
+			last = at
+		case <-time.After(3 * time.Second):
+			t.Fatalf("only %d of %d nodes are dialed", i, nodeCount)
+		}
+	}
+	if last.Sub(first) < 100*time.Millisecond {
+		t.Fatalf("dials are not spread, all in %s", last.Sub(first))
+	}
+}
+
+func Test_Server_SetAdvertisedPorts(t *testing.T) {
+	// a discovery service known to the server learns its ports by ping
+	remoteID, err := common.GenerateRandomAddress()
+	assert.Equal(t, err, nil)
+	remote, err := discovery.StartServerFat("0", hexutil.BytesToHex(remoteID.Bytes()), 0, nil)
+	assert.Equal(t, err, nil)
+	defer remote.Stop()
+	_, remoteUDPPort := remote.AdvertisedPorts()
+
+	srv := newTestServer(t)
+	srv.StaticNodes = []*discovery.Node{discovery.NewNode(*remoteID, net.ParseIP("127.0.0.1"), remoteUDPPort)}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	tcpPort, udpPort := srv.AdvertisedPorts()
+	assert.Equal(t, tcpPort, srv.listeners[0].Addr().(*net.TCPAddr).Port)
+	assert.Equal(t, udpPort != 0, true)
+
+	assert.Equal(t, srv.SetAdvertisedPorts(4000, 4001), nil)
+	tcpPort, udpPort = srv.AdvertisedPorts()
+	assert.Equal(t, tcpPort, 4000)
+	assert.Equal(t, udpPort, 4001)
+
+	// the handshake carries the new TCP port
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	recv, err := newPeer(conn, log.GetLogger("p2p", true)).recvRawMsg()
+	assert.Equal(t, err, nil)
+	hs, err := decodeHandshake(recv.payload, defaultMaxHandshakeCaps)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hs.TCPPort, uint16(4000))
+
+	// the ping of discovery carries the new ports
+	self := common.HexToAddress(srv.MyNodeID)
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range remote.Database().GetCopy() {
+			if n.ID == self && n.TCPPort == 4000 {
+				assert.Equal(t, n.UDPPort, 4001)
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("advertised ports are not announced")
+}
+
+func Test_Server_ConfigureConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	srv := newTestServer(t)
+	assert.Equal(t, srv.configureConn(conn), nil)
+
+	srv.TCPNagle = true
+	srv.TCPReadBuffer = 64 * 1024
+	srv.TCPWriteBuffer = 64 * 1024
+	assert.Equal(t, srv.configureConn(conn), nil)
+
+	srv.TCPKeepAlivePeriod = 5 * time.Second
+	assert.Equal(t, srv.configureConn(conn), nil)
+	srv.TCPKeepAlivePeriod = -1
+	assert.Equal(t, srv.configureConn(conn), nil)
+
+	// options are skipped for non-tcp connections
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	assert.Equal(t, srv.configureConn(c1), nil)
+}
+
+func Test_Server_AddProtocol(t *testing.T) {
+	base := newTestServerProtocol("base")
+	srv := newTestServer(t, base)
+	proto := newTestServerProtocol("new")
+	assert.Equal(t, srv.AddProtocol(proto) != nil, true)
+
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	remote := testHandshake(t, conn, node.ID, []Cap{base.cap()})
+	base.waitAdded(t)
+
+	assert.Equal(t, srv.AddProtocol(proto), nil)
+	assert.Equal(t, srv.AddProtocol(proto) != nil, true)
+
+	// the remote is told the protoCode of the new protocol
+	for {
+		recv, err := remote.recvRawMsg()
+		assert.Equal(t, err, nil)
+		if recv.Code() != ctlMsgCapsUpdate {
+			continue
+		}
+		var updates []capUpdate
+		assert.Equal(t, recv.Decode(&updates), nil)
+		assert.Equal(t, len(updates), 1)
+		assert.Equal(t, updates[0].Cap, proto.cap())
+		assert.Equal(t, updates[0].ProtoCode, uint16(baseProtoCode+1))
+		break
+	}
+
+	// the peer joins the new protocol once the remote accepts it
+	select {
+	case <-proto.added:
+		t.Fatal("peer is added before the remote accepts")
+	case <-time.After(100 * time.Millisecond):
+	}
+	payload, err := common.Serialize([]capAck{{proto.cap(), uint16(baseProtoCode + 1), true}})
+	assert.Equal(t, err, nil)
+	ack := &msg{protoCode: ctlProtoCode, Message: Message{msgCode: ctlMsgCapsAck, size: uint32(len(payload)), payload: payload}}
+	assert.Equal(t, remote.sendRawMsg(ack), nil)
+	assert.Equal(t, proto.waitAdded(t).node.ID, node.ID)
+}
+
+func Test_Server_SessionMetrics(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	proto.waitAdded(t)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for srv.Metrics().Churn == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("peer session is not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	metrics := srv.Metrics()
+	assert.Equal(t, metrics.Churn, uint64(1))
+	assert.Equal(t, metrics.Sessions.Count, uint64(1))
+	assert.Equal(t, metrics.Sessions.Counts[0], uint64(1))
+	if metrics.Sessions.Sum < 50*time.Millisecond || metrics.Sessions.Sum > 3*time.Second {
+		t.Fatalf("session duration %s is not plausible", metrics.Sessions.Sum)
+	}
+}
+
+func Test_Server_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	protoA, protoB := newTestServerProtocol("test"), newTestServerProtocol("test")
+	srvA, srvB := newTestServer(t, protoA), newTestServer(t, protoB)
+	srvA.ListenAddr = unixAddrPrefix + filepath.Join(dir, "a.sock")
+	srvB.ListenAddr = unixAddrPrefix + filepath.Join(dir, "b.sock")
+
+	nodeA := discovery.NewNode(common.HexToAddress(srvA.MyNodeID), net.ParseIP("127.0.0.1"), 1)
+	nodeB := discovery.NewNode(common.HexToAddress(srvB.MyNodeID), net.ParseIP("127.0.0.1"), 1)
+	srvA.StaticNodes = []*discovery.Node{nodeB}
+	srvB.StaticNodes = []*discovery.Node{nodeA}
+	srvB.NodeAddrs = map[common.Address]string{nodeA.ID: srvA.ListenAddr}
+	srvB.DialJitter = -1
+
+	assert.Equal(t, srvA.Start(), nil)
+	defer srvA.Stop()
+	assert.Equal(t, srvA.ListenAddr, unixAddrPrefix+filepath.Join(dir, "a.sock"))
+	assert.Equal(t, srvB.Start(), nil)
+	defer srvB.Stop()
+
+	// B dials A over the unix socket
+	assert.Equal(t, protoA.waitAdded(t).node.ID, nodeB.ID)
+	assert.Equal(t, protoB.waitAdded(t).node.ID, nodeA.ID)
+}
+
+func Test_Server_BootstrapNodes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+
+	srv := newTestServer(t)
+	id, err := common.GenerateRandomAddress()
+	assert.Equal(t, err, nil)
+	// nodes are dialed at UDPPort, see Server.dialAddr
+	boot := discovery.NewNode(*id, net.ParseIP("127.0.0.1"), listener.Addr().(*net.TCPAddr).Port)
+	srv.BootstrapNodes = []*discovery.Node{boot}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	// the bootstrap node is not kept in the discovery database
+	assert.Equal(t, len(srv.kadDB.GetCopy()), 0)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(3 * time.Second):
+		t.Fatal("bootstrap node is not dialed")
+	}
+}
+
+func Test_Server_HandshakeTimeout(t *testing.T) {
+	srv := newTestServer(t, newTestServerProtocol("test"))
+	srv.HandshakeTimeout = 100 * time.Millisecond
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	setupConn := func(remote func(conn net.Conn)) {
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		go remote(c2)
+
+		errc := make(chan error, 1)
+		go func() { errc <- srv.setupConn(c1, inboundConn, nil) }()
+		select {
+		case err := <-errc:
+			assert.Equal(t, err != nil, true)
+		case <-time.After(time.Second):
+			t.Fatal("handshake is not timed out")
+		}
+	}
+
+	// the remote connects but never reads, the handshake write blocks
+	setupConn(func(conn net.Conn) {})
+
+	// the remote reads the handshake but never replies
+	setupConn(func(conn net.Conn) {
+		newPeer(conn, log.GetLogger("p2p", true)).recvRawMsg()
+	})
+}
+
+// testDialer records dialed addresses and refuses all dials
+type testDialer struct {
+	addrs chan string
+}
+
+func (d *testDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.addrs <- network + "/" + address
+	return nil, errors.New("refused by test dialer")
+}
+
+func Test_Server_Dialer(t *testing.T) {
+	srv := newTestServer(t)
+	static, boot := newTestNode(t), newTestNode(t)
+	boot.UDPPort = 2
+	srv.StaticNodes = []*discovery.Node{static}
+	srv.BootstrapNodes = []*discovery.Node{boot}
+	srv.DialJitter = -1
+	dialer := &testDialer{addrs: make(chan string, 16)}
+	srv.Dialer = dialer
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	dialed := make(map[string]bool)
+	for len(dialed) < 2 {
+		select {
+		case addr := <-dialer.addrs:
+			dialed[addr] = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("outbound dials are not through dialer, dialed %v", dialed)
+		}
+	}
+	assert.Equal(t, dialed["tcp/127.0.0.1:1"], true)
+	assert.Equal(t, dialed["tcp/127.0.0.1:2"], true)
+}
+
+// blockingDialer blocks dials until their context is done
+type blockingDialer struct {
+	dialing chan struct{}
+	errs    chan error
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialing <- struct{}{}
+	<-ctx.Done()
+	d.errs <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func Test_Server_StopCancelsDial(t *testing.T) {
+	srv := newTestServer(t)
+	srv.StaticNodes = []*discovery.Node{newTestNode(t)}
+	srv.DialJitter = -1
+	srv.ShutdownTimeout = time.Second
+	dialer := &blockingDialer{dialing: make(chan struct{}, 1), errs: make(chan error, 1)}
+	srv.Dialer = dialer
+	assert.Equal(t, srv.Start(), nil)
+
+	select {
+	case <-dialer.dialing:
+	case <-time.After(3 * time.Second):
+		t.Fatal("node is not dialed")
+	}
+	assert.Equal(t, srv.Stop(), nil)
+	assert.Equal(t, <-dialer.errs, context.Canceled)
+}
+
+func Test_Server_DiscoveryFailure(t *testing.T) {
+	// the udp port is taken, discovery can not start
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+
+	srv := newTestServer(t)
+	srv.KadPort = strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+	assert.Equal(t, srv.Start() != nil, true)
+	assert.Equal(t, srv.isRunning(), false)
+
+	// scheduleTasks is safe without discovery
+	srv.scheduleTasks()
+}
+
+func Test_Server_ProtoTableOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	// protocols are registered in different order at each end
+	a1, b1 := newTestServerProtocol("a"), newTestServerProtocol("b")
+	a2, b2 := newTestServerProtocol("a"), newTestServerProtocol("b")
+	srv1, srv2 := newTestServer(t, a1, b1), newTestServer(t, b2, a2)
+	srv1.ListenAddr = unixAddrPrefix + filepath.Join(dir, "1.sock")
+	srv2.ListenAddr = unixAddrPrefix + filepath.Join(dir, "2.sock")
+	node1 := discovery.NewNode(common.HexToAddress(srv1.MyNodeID), net.ParseIP("127.0.0.1"), 1)
+	node2 := discovery.NewNode(common.HexToAddress(srv2.MyNodeID), net.ParseIP("127.0.0.1"), 1)
+	srv1.StaticNodes = []*discovery.Node{node2}
+	srv2.StaticNodes = []*discovery.Node{node1}
+	srv2.NodeAddrs = map[common.Address]string{node1.ID: srv1.ListenAddr}
+	srv2.DialJitter = -1
+	assert.Equal(t, srv1.Start(), nil)
+	defer srv1.Stop()
+	assert.Equal(t, srv2.Start(), nil)
+	defer srv2.Stop()
+
+	p1 := a1.waitAdded(t)
+	b1.waitAdded(t)
+	p2 := a2.waitAdded(t)
+	b2.waitAdded(t)
+	assert.Equal(t, p1.capMap[a1.cap().String()], p2.capMap[a2.cap().String()])
+	assert.Equal(t, p1.capMap[b1.cap().String()], p2.capMap[b2.cap().String()])
+
+	// messages are routed to the same protocol at the remote
+	m, _ := NewMessage(1, "to a")
+	assert.Equal(t, p1.SendMsg(&a1.Protocol, m), nil)
+	select {
+	case recv := <-a2.msgs:
+		var content string
+		recv.Decode(&content)
+		assert.Equal(t, content, "to a")
+	case <-b2.msgs:
+		t.Fatal("message is routed to another protocol")
+	case <-time.After(3 * time.Second):
+		t.Fatal("message is not received")
+	}
+}
+
+func Test_Server_ProtoTableDiff(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	p := testHandshakeOnly(t, conn, node.ID, []Cap{proto.cap()})
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgProtoTable)
+
+	// the remote claims another protoCode for the protocol
+	table := []capUpdate{{proto.cap(), uint16(baseProtoCode + 1)}}
+	payload, _ := common.Serialize(table)
+	tableMsg := &msg{
+		protoCode: ctlProtoCode,
+		Message:   Message{msgCode: ctlMsgProtoTable, size: uint32(len(payload)), payload: payload},
+	}
+	assert.Equal(t, p.sendRawMsg(tableMsg), nil)
+
+	recv, err = p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(discProtocolError))
+
+	select {
+	case <-proto.added:
+		t.Fatal("peer with different protoCode table is added")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_Server_Broadcast(t *testing.T) {
+	proto, other := newTestServerProtocol("test"), newTestServerProtocol("other")
+	srv := newTestServer(t, proto, other)
+	nodes := []*discovery.Node{newTestNode(t), newTestNode(t), newTestNode(t)}
+	srv.StaticNodes = nodes
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	// the last remote does not support proto
+	capsList := [][]Cap{{proto.cap()}, {proto.cap()}, {other.cap()}}
+	var remotes []*Peer
+	for i, node := range nodes {
+		conn, err := net.Dial("tcp", srv.ListenAddr)
+		assert.Equal(t, err, nil)
+		defer conn.Close()
+		remotes = append(remotes, testHandshake(t, conn, node.ID, capsList[i]))
+	}
+	proto.waitAdded(t)
+	proto.waitAdded(t)
+	other.waitAdded(t)
+
+	m, _ := NewMessage(1, "broadcast")
+	assert.Equal(t, len(srv.Broadcast(&proto.Protocol, m)), 0)
+
+	for _, remote := range remotes[:2] {
+		recv, err := remote.recvRawMsg()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, recv.protoCode, uint16(baseProtoCode))
+		var content string
+		assert.Equal(t, recv.Decode(&content), nil)
+		assert.Equal(t, content, "broadcast")
+	}
+
+	remotes[2].conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := remotes[2].conn.Read(make([]byte, headerSize))
+	netErr, ok := err.(net.Error)
+	assert.Equal(t, ok && netErr.Timeout(), true)
+}
+
+func Test_Server_BroadcastExcept(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	nodes := []*discovery.Node{newTestNode(t), newTestNode(t)}
+	srv.StaticNodes = nodes
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	var remotes []*Peer
+	for _, node := range nodes {
+		conn, err := net.Dial("tcp", srv.ListenAddr)
+		assert.Equal(t, err, nil)
+		defer conn.Close()
+		remotes = append(remotes, testHandshake(t, conn, node.ID, []Cap{proto.cap()}))
+		proto.waitAdded(t)
+	}
+
+	// the first remote is the source of the message
+	m, _ := NewMessage(1, "gossip")
+	assert.Equal(t, len(srv.BroadcastExcept(&proto.Protocol, m, nodes[0].ID)), 0)
+
+	recv, err := remotes[1].recvRawMsg()
+	assert.Equal(t, err, nil)
+	var content string
+	assert.Equal(t, recv.Decode(&content), nil)
+	assert.Equal(t, content, "gossip")
+
+	remotes[0].conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = remotes[0].conn.Read(make([]byte, headerSize))
+	netErr, ok := err.(net.Error)
+	assert.Equal(t, ok && netErr.Timeout(), true)
+}
+
+// testPanicProtocol panics in Run
+type testPanicProtocol struct {
+	Protocol
+}
+
+func (p *testPanicProtocol) Run() {
+	panic("test panic")
+}
+
+func (p *testPanicProtocol) GetBaseProtocol() *Protocol {
+	return &p.Protocol
+}
+
+// testReturnProtocol counts its runs, Run returns once release is closed
+type testReturnProtocol struct {
+	Protocol
+	runs    chan struct{}
+	release chan struct{}
+}
+
+func (p *testReturnProtocol) Run() {
+	p.runs <- struct{}{}
+	<-p.release
+}
+
+func (p *testReturnProtocol) GetBaseProtocol() *Protocol {
+	return &p.Protocol
+}
+
+func Test_Server_RestartProtocol(t *testing.T) {
+	proto := &testReturnProtocol{
+		Protocol: Protocol{Name: "return", Version: 1},
+		runs:     make(chan struct{}, 4),
+		release:  make(chan struct{}),
+	}
+	srv := newTestServer(t, proto)
+	assert.Equal(t, srv.Start(), nil)
+	<-proto.runs
+	assert.Equal(t, srv.Stop(), nil)
+
+	// Run of the former start is still running, it is not run twice
+	assert.Equal(t, srv.Start(), nil)
+	select {
+	case <-proto.runs:
+		t.Fatal("protocol runs twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(proto.release)
+	<-proto.GetBaseProtocol().done
+	assert.Equal(t, srv.Stop(), nil)
+
+	// Run returned, it runs again at next start
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+	select {
+	case <-proto.runs:
+	case <-time.After(time.Second):
+		t.Fatal("protocol is not run again")
+	}
+	<-proto.GetBaseProtocol().done
+}
+
+func Test_Server_ProtocolPanic(t *testing.T) {
+	proto := &testPanicProtocol{Protocol: *newTestProtocol("panic")}
+	srv := newTestServer(t, proto)
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	select {
+	case err := <-srv.Errors():
+		assert.Equal(t, err.Error(), "protocol panic/1 panic, test panic")
+	case <-time.After(3 * time.Second):
+		t.Fatal("protocol panic is not reported")
+	}
+
+	// the protocol is marked quit
+	select {
+	case <-proto.done:
+	case <-time.After(time.Second):
+		t.Fatal("protocol is not marked quit")
+	}
+
+	// the server keeps running
+	assert.Equal(t, srv.AddProtocol(newTestServerProtocol("test")), nil)
+}
+
+func Test_Server_ProtocolPanicPeer(t *testing.T) {
+	panicProto := &testPanicProtocol{Protocol: *newTestProtocol("panic")}
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, panicProto, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+	<-srv.Errors()
+
+	// a peer sharing the panicked protocol joins the others
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	remote := testHandshake(t, conn, node.ID, []Cap{panicProto.cap(), proto.cap()})
+	peer := proto.waitAdded(t)
+
+	// messages of the panicked protocol are dropped
+	panicCode, ok := peer.protoCode(&panicProto.Protocol)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, remote.sendRawMsg(&msg{protoCode: panicCode, Message: Message{msgCode: 1}}), nil)
+	testCode, _ := peer.protoCode(&proto.Protocol)
+	assert.Equal(t, remote.sendRawMsg(&msg{protoCode: testCode, Message: Message{msgCode: 2}}), nil)
+	select {
+	case m := <-proto.msgs:
+		assert.Equal(t, m.Code(), uint16(2))
+	case <-time.After(time.Second):
+		t.Fatal("message after the dropped one is not received")
+	}
+
+	// the peer leaves the running protocol
+	conn.Close()
+	select {
+	case <-proto.deleted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("peer is not deleted")
+	}
+}
+
+func Test_Server_OutboundReserve(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	srv.MaxPeers = 3
+	srv.OutboundReserve = 0.3
+	in1, in2, in3 := newTestNode(t), newTestNode(t), newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{in1, in2, in3}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	out := newTestNode(t)
+	srv.NodeAddrs = map[common.Address]string{out.ID: listener.Addr().String()}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+	assert.Equal(t, srv.maxInboundPeers(), 2)
+
+	// inbound peers fill the non-reserved slots
+	for _, node := range []*discovery.Node{in1, in2} {
+		conn, err := net.Dial("tcp", srv.ListenAddr)
+		assert.Equal(t, err, nil)
+		defer conn.Close()
+		testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+		proto.waitAdded(t)
+	}
+
+	// further inbound is rejected
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, headerSize))
+	assert.Equal(t, err, io.EOF)
+
+	// the reserved slot is left for outbound
+	go srv.dial(out)
+	outConn, err := listener.Accept()
+	assert.Equal(t, err, nil)
+	defer outConn.Close()
+	testHandshake(t, outConn, out.ID, []Cap{proto.cap()})
+	assert.Equal(t, proto.waitAdded(t).node.ID, out.ID)
+}
+
+func Test_Server_RejectNonSeeleConn(t *testing.T) {
+	srv := newTestServer(t, newTestServerProtocol("test"))
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.Equal(t, err, nil)
+
+	// the server closes the connection after its own handshake frame, a reset is
+	// possible since the request is not read completely
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = ioutil.ReadAll(conn)
+	netErr, ok := err.(net.Error)
+	assert.Equal(t, ok && netErr.Timeout(), false)
+}
+
+func Test_Server_KnownNodes(t *testing.T) {
+	srv := newTestServer(t)
+	node1, node2 := newTestNode(t), newTestNode(t)
+	node2.TCPPort = 2
+	srv.StaticNodes = []*discovery.Node{node1, node2}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	known := make(map[common.Address]*discovery.Node)
+	for _, node := range srv.KnownNodes() {
+		known[node.ID] = node
+	}
+	assert.Equal(t, len(known), 2)
+	assert.Equal(t, known[node1.ID].IP.String(), "127.0.0.1")
+	assert.Equal(t, known[node1.ID].UDPPort, 1)
+	assert.Equal(t, known[node2.ID].TCPPort, 2)
+}
+
+func Test_Server_AcceptConcurrency(t *testing.T) {
+	const count = 20
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	srv.MaxPendingPeers = 4
+	srv.AcceptConcurrency = 4
+	var nodes []*discovery.Node
+	for i := 0; i < count; i++ {
+		nodes = append(nodes, newTestNode(t))
+	}
+	srv.StaticNodes = nodes
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	// all connections are made at once
+	conns := make(chan net.Conn, count)
+	for _, node := range nodes {
+		go func(node *discovery.Node) {
+			conn, err := net.Dial("tcp", srv.ListenAddr)
+			if err != nil {
+				return
+			}
+			conns <- conn
+			testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+		}(node)
+	}
+
+	added := make(map[common.Address]bool)
+	for i := 0; i < count; i++ {
+		added[proto.waitAdded(t).node.ID] = true
+	}
+	assert.Equal(t, len(added), count)
+	close(conns)
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+func Test_Server_ProtocolErrorBackoff(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	remote := testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	proto.waitAdded(t)
+
+	// a frame of unknown protoCode is a protocol error
+	bad := &msg{protoCode: 100, Message: Message{msgCode: 1}}
+	assert.Equal(t, remote.sendRawMsg(bad), nil)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for srv.Metrics().DiscReasons[discProtocolError] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("peer is not dropped for protocol error")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the node is not redialed when the dial history expires
+	probe := time.Now().Add(2 * dialHistoryExpiry)
+	assert.Equal(t, srv.dialHistory.add(node.ID, probe, 0), false)
+}
+
+func Test_Server_ExportImportPeers(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv1 := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv1.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv1.Start(), nil)
+
+	conn, err := net.Dial("tcp", srv1.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	proto.waitAdded(t)
+	srv1.Stop()
+	data := srv1.ExportPeers()
+
+	// the restarted node dials the exported peer at once
+	srv2 := newTestServer(t)
+	assert.Equal(t, srv2.ImportPeers(data), nil)
+	dialer := &testDialer{addrs: make(chan string, 16)}
+	srv2.Dialer = dialer
+	srv2.DialJitter = -1
+	assert.Equal(t, srv2.Start(), nil)
+
+	select {
+	case addr := <-dialer.addrs:
+		assert.Equal(t, addr, "tcp/127.0.0.1:1")
+	case <-time.After(3 * time.Second):
+		t.Fatal("imported peer is not dialed")
+	}
+
+	// the imported peers are dialed at the first Start only
+	srv2.Stop()
+	assert.Equal(t, srv2.Start(), nil)
+	defer srv2.Stop()
+	select {
+	case addr := <-dialer.addrs:
+		t.Fatalf("imported peer %s is dialed again after restart", addr)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func Test_Server_LocalNode(t *testing.T) {
+	srv := newTestServer(t)
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	node := srv.LocalNode()
+	assert.Equal(t, node.ID, common.HexToAddress(srv.MyNodeID))
+	assert.Equal(t, node.IP.String(), "127.0.0.1")
+	_, port, _ := net.SplitHostPort(srv.ListenAddr)
+	assert.Equal(t, strconv.Itoa(node.TCPPort), port)
+	tcpPort, udpPort := srv.AdvertisedPorts()
+	assert.Equal(t, node.TCPPort, tcpPort)
+	assert.Equal(t, node.UDPPort, udpPort)
+	assert.Equal(t, node.UDPPort != 0, true)
+}
+
+func Test_Server_LocalNodeIP(t *testing.T) {
+	srv := newTestServer(t)
+	srv.ListenAddr = ":0"
+	assert.Equal(t, srv.Start(), nil)
+	// no address of self is known when listening on all interfaces
+	assert.Equal(t, srv.LocalNode().IP == nil, true)
+	srv.Stop()
+
+	srv.AdvertisedIP = net.ParseIP("203.0.113.7")
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+	assert.Equal(t, srv.LocalNode().IP.String(), "203.0.113.7")
+}
+
+func Test_Server_ReusedNonce(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	expectReject := func(nounce uint32) {
+		conn, err := net.Dial("tcp", srv.ListenAddr)
+		assert.Equal(t, err, nil)
+		defer conn.Close()
+		p := testHandshakeNounce(t, conn, node.ID, []Cap{proto.cap()}, nounce)
+		recv, err := p.recvRawMsg()
+		assert.Equal(t, err, nil)
+		assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+		var reason uint
+		assert.Equal(t, recv.Decode(&reason), nil)
+		assert.Equal(t, reason, uint(discHandshakeReject))
+	}
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	testEchoProtoTable(t, testHandshakeNounce(t, conn, node.ID, []Cap{proto.cap()}, 42))
+	proto.waitAdded(t)
+	conn.Close()
+	select {
+	case <-proto.deleted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("peer is not deleted")
+	}
+
+	// the replayed handshake is rejected even though the peer has quit
+	expectReject(42)
+	expectReject(0)
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func Test_Server_LogLevel(t *testing.T) {
+	var out lockedBuffer
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	srv.Logger = log.NewLogger(&out, log.InfoLevel)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	// scheduleTasks is called by the server loop before and after adding the peer
+	proto.waitAdded(t)
+
+	logs := out.String()
+	assert.Equal(t, strings.Contains(logs, "handshaked"), true)
+	assert.Equal(t, strings.Contains(logs, "direction=inbound"), true)
+	// hot path logs are debug level
+	assert.Equal(t, strings.Contains(logs, "addpeer"), false)
+	assert.Equal(t, strings.Contains(logs, "scheduleTasks"), false)
+}
+
+func Test_Server_InboundAdvertisedPort(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	// the node is unknown to discovery
+	node := newTestNode(t)
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	hs := &protoHandShake{Caps: []Cap{proto.cap()}, Nounce: 1, TCPPort: 30303}
+	copy(hs.NodeID[0:], node.ID[0:])
+	testEchoProtoTable(t, testHandshakeMsg(t, conn, hs))
+
+	peer := proto.waitAdded(t)
+	assert.Equal(t, peer.node.ID, node.ID)
+	assert.Equal(t, peer.node.IP.String(), "127.0.0.1")
+	assert.Equal(t, peer.node.TCPPort, 30303)
+	assert.Equal(t, srv.dialAddr(peer.node), "127.0.0.1:30303")
+}
+
+func Test_Server_InboundUnknownNode(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	// the node is unknown to discovery and does not advertise a port
+	node := newTestNode(t)
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+
+	peer := proto.waitAdded(t)
+	assert.Equal(t, peer.node.ID, node.ID)
+	assert.Equal(t, peer.node.IP.String(), "127.0.0.1")
+}
+
+func Test_Server_Healthy(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	healthy, reason := srv.Healthy()
+	assert.Equal(t, healthy, false)
+	assert.Equal(t, reason, ErrServerNotRunning.Error())
+
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	srv.HealthGracePeriod = 50 * time.Millisecond
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+	healthy, _ = srv.Healthy()
+	assert.Equal(t, healthy, true)
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	proto.waitAdded(t)
+	// the grace period does not apply with peers
+	time.Sleep(100 * time.Millisecond)
+	healthy, _ = srv.Healthy()
+	assert.Equal(t, healthy, true)
+}
+
+func Test_Server_HealthyNoPeers(t *testing.T) {
+	srv := newTestServer(t)
+	srv.HealthGracePeriod = 50 * time.Millisecond
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	healthy, _ := srv.Healthy()
+	assert.Equal(t, healthy, true)
+	time.Sleep(100 * time.Millisecond)
+	healthy, reason := srv.Healthy()
+	assert.Equal(t, healthy, false)
+	assert.Equal(t, strings.HasPrefix(reason, "no peers"), true)
+}
+
+func Test_Server_HealthyListenerDown(t *testing.T) {
+	srv := newTestServer(t)
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	srv.listeners[0].Close()
+	for i := 0; ; i++ {
+		healthy, reason := srv.Healthy()
+		if !healthy {
+			assert.Equal(t, reason, "listener down")
+			break
+		}
+		if i == 100 {
+			t.Fatal("server is healthy with listener down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_Server_PauseResume(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	srv.Pause()
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	recv, err := newPeer(conn, log.GetLogger("p2p", true)).recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(discBusy))
+	conn.Close()
+
+	srv.Resume()
+	conn, err = net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	proto.waitAdded(t)
+}
+
+func Test_Server_NotRunning(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t)
+	m, _ := NewMessage(1, "not running")
+
+	assert.Equal(t, srv.AddProtocol(proto), ErrServerNotRunning)
+	assert.Equal(t, srv.Broadcast(&proto.Protocol, m), []error{ErrServerNotRunning})
+	assert.Equal(t, srv.BroadcastExcept(&proto.Protocol, m), []error{ErrServerNotRunning})
+	assert.Equal(t, srv.SetAdvertisedPorts(1, 2), ErrServerNotRunning)
+	healthy, reason := srv.Healthy()
+	assert.Equal(t, healthy, false)
+	assert.Equal(t, reason, ErrServerNotRunning.Error())
+
+	// methods without error are safe
+	tcpPort, udpPort := srv.AdvertisedPorts()
+	assert.Equal(t, tcpPort, 0)
+	assert.Equal(t, udpPort, 0)
+	assert.Equal(t, srv.LocalNode() == nil, true)
+	assert.Equal(t, srv.Metrics() == nil, true)
+	assert.Equal(t, srv.KnownNodes() == nil, true)
+	assert.Equal(t, srv.Errors() == nil, true)
+	srv.Stop()
+
+	// and after Stop
+	assert.Equal(t, srv.Start(), nil)
+	srv.Stop()
+	assert.Equal(t, srv.AddProtocol(proto), ErrServerNotRunning)
+	assert.Equal(t, srv.Broadcast(&proto.Protocol, m), []error{ErrServerNotRunning})
+	assert.Equal(t, srv.LocalNode() == nil, true)
+}
+
+func Benchmark_Server_NewHandshakeMsg(b *testing.B) {
+	id, err := common.GenerateRandomAddress()
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv := &Server{Config: Config{MyNodeID: hexutil.BytesToHex(id.Bytes())}}
+	caps := []Cap{{"a", 1}, {"b", 1}, {"c", 2}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := srv.newHandshakeMsg(caps); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_Server_NetworkIDMismatch(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	srv.NetworkID = 1
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	hs := &protoHandShake{Caps: []Cap{proto.cap()}, Nounce: 1, NetworkID: 2}
+	copy(hs.NodeID[0:], node.ID[0:])
+	p := testHandshakeMsg(t, conn, hs)
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(discNetworkMismatch))
+}
+
+func Test_Server_NegotiatedCaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	// only protocol b is supported at both ends
+	a1, b1 := newTestServerProtocol("a"), newTestServerProtocol("b")
+	b2, c2 := newTestServerProtocol("b"), newTestServerProtocol("c")
+	srv1, srv2 := newTestServer(t, a1, b1), newTestServer(t, b2, c2)
+	srv1.ListenAddr = unixAddrPrefix + filepath.Join(dir, "1.sock")
+	srv2.ListenAddr = unixAddrPrefix + filepath.Join(dir, "2.sock")
+	node1 := discovery.NewNode(common.HexToAddress(srv1.MyNodeID), net.ParseIP("127.0.0.1"), 1)
+	node2 := discovery.NewNode(common.HexToAddress(srv2.MyNodeID), net.ParseIP("127.0.0.1"), 1)
+	srv1.StaticNodes = []*discovery.Node{node2}
+	srv2.StaticNodes = []*discovery.Node{node1}
+	srv2.NodeAddrs = map[common.Address]string{node1.ID: srv1.ListenAddr}
+	srv2.DialJitter = -1
+	assert.Equal(t, srv1.Start(), nil)
+	defer srv1.Stop()
+	assert.Equal(t, srv2.Start(), nil)
+	defer srv2.Stop()
+
+	p1 := b1.waitAdded(t)
+	p2 := b2.waitAdded(t)
+	assert.Equal(t, p1.Caps(), []Cap{b1.cap()})
+	assert.Equal(t, p2.Caps(), []Cap{b2.cap()})
+
+	m, _ := NewMessage(1, "to a")
+	assert.Equal(t, p1.SendMsg(&a1.Protocol, m), errProtoNotShared)
+	assert.Equal(t, p2.SendMsg(&c2.Protocol, m), errProtoNotShared)
+}
+
+func Test_Server_ShutdownTimeout(t *testing.T) {
+	// the remote accepts but never does the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	srv := newTestServer(t)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	srv.NodeAddrs = map[common.Address]string{node.ID: listener.Addr().String()}
+	srv.DialJitter = -1
+	srv.HandshakeTimeout = time.Minute
+	srv.ShutdownTimeout = 100 * time.Millisecond
+	assert.Equal(t, srv.Start(), nil)
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+		defer conn.Close()
+	case <-time.After(3 * time.Second):
+		t.Fatal("node is not dialed")
+	}
+	// the handshake is sent once the dial is done
+	_, err = newPeer(conn, log.GetLogger("p2p", true)).recvRawMsg()
+	assert.Equal(t, err, nil)
+
+	// the dial goroutine is stuck in handshake
+	start := time.Now()
+	assert.Equal(t, srv.Stop(), ErrShutdownTimeout)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Stop returns after %s", d)
+	}
+
+	// the stuck handshake quits after its connection is closed by force
+	done := make(chan struct{})
+	go func() {
+		srv.loopWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("stuck handshake does not quit")
+	}
+}
+
+// testBroadcastProtocol broadcasts continuously while handling its peers
+type testBroadcastProtocol struct {
+	*testServerProtocol
+	srv *Server
+}
+
+func (p *testBroadcastProtocol) Run() {
+	for {
+		select {
+		case peer := <-p.AddPeerCh:
+			p.added <- peer
+		case peer := <-p.DelPeerCh:
+			p.deleted <- peer
+		case <-p.ReadMsgCh:
+		default:
+			m, _ := NewMessage(1, "tick")
+			p.srv.Broadcast(&p.Protocol, m)
+		}
+	}
+}
+
+func Test_Server_StopBroadcastingProtocol(t *testing.T) {
+	proto := &testBroadcastProtocol{testServerProtocol: newTestServerProtocol("test")}
+	srv := newTestServer(t, proto)
+	proto.srv = srv
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	srv.ShutdownTimeout = 2 * time.Second
+	assert.Equal(t, srv.Start(), nil)
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	// drain the broadcasts, so that writes to the remote do not stall
+	go io.Copy(ioutil.Discard, conn)
+	proto.waitAdded(t)
+
+	// the protocol keeps broadcasting while the peer leaves it
+	assert.Equal(t, srv.Stop(), nil)
+	select {
+	case <-proto.deleted:
+	case <-time.After(time.Second):
+		t.Fatal("peer is not deleted")
+	}
+}
+
+func Test_Server_StopAfterDuplicatePeer(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	srv.ShutdownTimeout = 2 * time.Second
+	assert.Equal(t, srv.Start(), nil)
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	proto.waitAdded(t)
+
+	dup, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer dup.Close()
+	p := testHandshake(t, dup, node.ID, []Cap{proto.cap()})
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+
+	// the connected peer quits with the server, not with the rejected duplicate
+	assert.Equal(t, srv.Stop(), nil)
+	assert.Equal(t, (<-proto.deleted).node.ID, node.ID)
+	assert.Equal(t, atomic.LoadInt32(&srv.inboundPeers), int32(0))
+}
+
+func Test_Server_DuplicatePeerWhileBroadcasting(t *testing.T) {
+	proto := &testBroadcastProtocol{testServerProtocol: newTestServerProtocol("test")}
+	srv := newTestServer(t, proto)
+	proto.srv = srv
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	srv.ShutdownTimeout = 2 * time.Second
+	assert.Equal(t, srv.Start(), nil)
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	testHandshake(t, conn, node.ID, []Cap{proto.cap()})
+	go io.Copy(ioutil.Discard, conn)
+	proto.waitAdded(t)
+
+	// the duplicate is rejected without joining the broadcasting protocol
+	dup, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer dup.Close()
+	p := testHandshake(t, dup, node.ID, []Cap{proto.cap()})
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(discAlreadyConnected))
+
+	count := 0
+	assert.Equal(t, srv.doPeerOp(func(peers map[common.Address]*Peer) { count = len(peers) }), true)
+	assert.Equal(t, count, 1)
+	assert.Equal(t, srv.Stop(), nil)
+}
+
+func Test_Server_StopDiscovery(t *testing.T) {
+	srv := newTestServer(t)
+	assert.Equal(t, srv.Start(), nil)
+	_, udpPort := srv.AdvertisedPorts()
+	assert.Equal(t, srv.Stop(), nil)
+
+	// KadPort is free after Stop
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: udpPort})
+	assert.Equal(t, err, nil)
+	conn.Close()
+}
+
+// testDialConn returns a connection dialed to a local listener and the accepted end of it
+func testDialConn(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Equal(t, err, nil)
+	remote, err := listener.Accept()
+	assert.Equal(t, err, nil)
+	return conn, remote
+}
+
+func Test_Server_ReconnectRemoteReject(t *testing.T) {
+	srv := newTestServer(t, newTestServerProtocol("test"))
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	// dialRejected dials a server configured by config, which rejects the dial
+	dialRejected := func(config func(remote *Server)) *discovery.Node {
+		remote := newTestServer(t, newTestServerProtocol("test"))
+		config(remote)
+		assert.Equal(t, remote.Start(), nil)
+		defer remote.Stop()
+
+		node := discovery.NewNode(common.HexToAddress(remote.MyNodeID), net.ParseIP("127.0.0.1"), 1)
+		srv.dialHistory.add(node.ID, time.Now(), dialHistoryExpiry)
+		conn, err := net.Dial("tcp", remote.ListenAddr)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, srv.setupConn(conn, outboundConn, node) != nil, true)
+		return node
+	}
+
+	// the remote is busy after its handshake, it can be redialed at once
+	busy := dialRejected(func(remote *Server) {
+		remote.HandshakeValidator = func(caps []Cap, nodeID common.Address) error { return errors.New("busy") }
+		remote.HandshakeRejectReason = discTooManyPeers
+	})
+	assert.Equal(t, srv.dialHistory.ready(busy.ID, time.Now()), true)
+	assert.Equal(t, srv.reconnect.allowed(busy.ID), true)
+
+	// the remote is of another network, it is not redialed
+	other := dialRejected(func(remote *Server) { remote.NetworkID = srv.NetworkID + 1 })
+	assert.Equal(t, srv.reconnect.allowed(other.ID), false)
+}
+
+func Test_Server_ReconnectImpersonation(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	node, impostor := newTestNode(t), newTestNode(t)
+	conn, remote := testDialConn(t)
+	defer remote.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.setupConn(conn, outboundConn, node) }()
+
+	// the dialed node answers with another node ID
+	p := testHandshake(t, remote, impostor.ID, []Cap{proto.cap()})
+	assert.Equal(t, <-errc != nil, true)
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	assert.Equal(t, srv.reconnect.allowed(node.ID), false)
+}
+
+func Test_Server_UselessPeer(t *testing.T) {
+	proto := newTestServerProtocol("test")
+	srv := newTestServer(t, proto)
+	node := newTestNode(t)
+	srv.StaticNodes = []*discovery.Node{node}
+	assert.Equal(t, srv.Start(), nil)
+	defer srv.Stop()
+
+	conn, err := net.Dial("tcp", srv.ListenAddr)
+	assert.Equal(t, err, nil)
+	defer conn.Close()
+	p := testHandshakeOnly(t, conn, node.ID, []Cap{{"other", 1}})
+
+	// disconnected instead of the protoCode table
+	recv, err := p.recvRawMsg()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, recv.Code(), ctlMsgDiscCode)
+	var reason uint
+	assert.Equal(t, recv.Decode(&reason), nil)
+	assert.Equal(t, reason, uint(discUselessPeer))
+
+	select {
+	case <-proto.added:
+		t.Fatal("useless peer is added")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,28 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"net"
+)
+
+// Transport creates the listeners and outbound connections of the server, so that
+// tests can wire many servers in one process without real sockets.
+type Transport interface {
+	Dialer
+
+	// Listen listens on address of network, as net.Listen does
+	Listen(network, address string) (net.Listener, error)
+}
+
+// netTransport is the default transport of real sockets
+type netTransport struct {
+	net.Dialer
+}
+
+func (t *netTransport) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
@@ -0,0 +1,251 @@
+/**
+*  @file
+*  @copyright defined in go-seele/LICENSE
+ */
+
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/magiconair/properties/assert"
+	"github.com/seeleteam/go-seele/common"
+	"github.com/seeleteam/go-seele/p2p/discovery"
+)
+
+var (
+	errMemAddrInUse      = errors.New("mem address already in use")
+	errMemConnRefused    = errors.New("mem connection refused")
+	errMemListenerClosed = errors.New("mem listener closed")
+)
+
+// memNetwork is an in-memory transport, listeners are named by their address
+type memNetwork struct {
+	lock      sync.Mutex
+	listeners map[string]*memListener
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		listeners: make(map[string]*memListener),
+	}
+}
+
+func (n *memNetwork) Listen(network, address string) (net.Listener, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.listeners[address]; ok {
+		return nil, errMemAddrInUse
+	}
+	l := &memListener{
+		network: n,
+		addr:    memAddr(address),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+func (n *memNetwork) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n.lock.Lock()
+	l, ok := n.listeners[address]
+	n.lock.Unlock()
+	if !ok {
+		return nil, errMemConnRefused
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- newMemConn(remote):
+		return newMemConn(local), nil
+	case <-l.closed:
+	case <-ctx.Done():
+	}
+	local.Close()
+	remote.Close()
+	return nil, errMemConnRefused
+}
+
+type memListener struct {
+	network   *memNetwork
+	addr      memAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errMemListenerClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.network.lock.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// memConn buffers the writes to a pipe end, so that both ends can write before
+// reading as tcp connections with socket buffers do. Write deadlines are ignored
+// as writes never block.
+type memConn struct {
+	net.Conn
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+}
+
+func newMemConn(pipe net.Conn) *memConn {
+	c := &memConn{Conn: pipe}
+	c.cond = sync.NewCond(&c.lock)
+	go c.flush()
+	return c
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.queue = append(c.queue, append([]byte(nil), b...))
+	c.cond.Signal()
+	return len(b), nil
+}
+
+// flush writes the queued data to the pipe, the pipe is closed after the data
+// queued before Close is written or the write times out.
+func (c *memConn) flush() {
+	defer c.Conn.Close()
+	for {
+		c.lock.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if len(c.queue) == 0 {
+			c.lock.Unlock()
+			return
+		}
+		data := c.queue[0]
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+
+		if _, err := c.Conn.Write(data); err != nil {
+			c.Close()
+			return
+		}
+	}
+}
+
+func (c *memConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.Conn.SetWriteDeadline(time.Now().Add(discWriteTimeout))
+		c.cond.Signal()
+	}
+	return nil
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func Test_Transport_MemMesh(t *testing.T) {
+	const count = 10
+	network := newMemNetwork()
+	servers := make([]*Server, count)
+	nodes := make([]*discovery.Node, count)
+	for i := range servers {
+		srv := newTestServer(t, newTestServerProtocol("test"))
+		srv.ListenAddr = fmt.Sprintf("node%d", i)
+		srv.Transport = network
+		srv.DialJitter = -1
+		srv.NodeAddrs = make(map[common.Address]string)
+		servers[i] = srv
+		nodes[i] = discovery.NewNode(common.HexToAddress(srv.MyNodeID), net.ParseIP("127.0.0.1"), 1)
+	}
+
+	// each node dials the nodes after it, which are started before it, so that
+	// every pair of nodes connects once
+	for i := count - 1; i >= 0; i-- {
+		srv := servers[i]
+		for j := i + 1; j < count; j++ {
+			srv.StaticNodes = append(srv.StaticNodes, nodes[j])
+			srv.NodeAddrs[nodes[j].ID] = servers[j].ListenAddr
+		}
+		assert.Equal(t, srv.Start(), nil)
+		defer srv.Stop()
+	}
+
+	peerIDs := func(srv *Server) []common.Address {
+		var ids []common.Address
+		srv.doPeerOp(func(peers map[common.Address]*Peer) {
+			for id := range peers {
+				ids = append(ids, id)
+			}
+		})
+		return ids
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < count; {
+		if len(peerIDs(servers[i])) == count-1 {
+			i++
+			continue
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node%d has %d of %d peers", i, len(peerIDs(servers[i])), count-1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// all nodes are reached through the peers of node0
+	index := make(map[common.Address]int)
+	for i, node := range nodes {
+		index[node.ID] = i
+	}
+	reached := map[int]bool{0: true}
+	for queue := []int{0}; len(queue) > 0; queue = queue[1:] {
+		for _, id := range peerIDs(servers[queue[0]]) {
+			if i := index[id]; !reached[i] {
+				reached[i] = true
+				queue = append(queue, i)
+			}
+		}
+	}
+	assert.Equal(t, len(reached), count)
+}
@@ -1,10 +1,11 @@
+//go:build windows
+// +build windows
+
 /**
 *  @file
 *  @copyright defined in go-seele/LICENSE
  */
 
-//+build windows
-
 package utils
 
 import (